@@ -1,83 +1,154 @@
 package main
 
 import (
+	"context"
 	"log/slog"
-	"net/http"
 	"os"
 	"os/signal"
-	"sync"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
-	"nullmail/internal/smtp"
+	"nullmail/pkg/nullmail"
 )
 
 func main() {
 	initLogger()
 
-	var wg sync.WaitGroup
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		startHealthServer()
-	}()
-
 	port := ":25"
 	if len(os.Args) > 1 {
 		port = os.Args[1]
 	}
 
-	server := smtp.NewSMTPServer(port)
+	// Without Redis, accepted mail would only live in process memory, where
+	// the web client cannot see it and a restart loses it
+	store, err := nullmail.NewRedisStoreFromEnv()
+	if err != nil {
+		slog.Error("Redis connection failed", "error", err)
+		os.Exit(1)
+	}
+
+	shutdownTimeout := envDuration("SHUTDOWN_TIMEOUT", nullmail.DefaultShutdownTimeout)
 
-	// Handle graceful shutdown
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	httpPort := os.Getenv("PORT")
+	if httpPort == "" {
+		httpPort = "8080"
+	}
+
+	devCADir := os.Getenv("TLS_DEV_CA_DIR")
+	if devCADir == "" {
+		devCADir = "certs"
+	}
 
-	go func() {
-		<-c
-		slog.Info("Shutting down servers...")
-		os.Exit(0)
-	}()
+	server := nullmail.New(nullmail.Options{
+		Addr:                port,
+		LocalDomains:        splitList(os.Getenv("SMTP_LOCAL_DOMAINS")),
+		Hostname:            os.Getenv("SMTP_HOSTNAME"),
+		TLSAddr:             os.Getenv("SMTPS_PORT"),
+		HTTPAddr:            ":" + httpPort,
+		Store:               store,
+		AuthUsers:           parseAuthUsers(os.Getenv("SMTP_AUTH_USERS")),
+		AuthAcceptAny:       os.Getenv("SMTP_AUTH_ACCEPT_ANY") == "true",
+		TLSCertFile:         os.Getenv("SSL_CERT_PATH"),
+		TLSKeyFile:          os.Getenv("SSL_KEY_PATH"),
+		TLSDevCADir:         devCADir,
+		RequireTLS:          os.Getenv("SMTP_REQUIRE_TLS") == "true",
+		CommandTimeout:      envDuration("SMTP_COMMAND_TIMEOUT", 0),
+		DataTimeout:         envDuration("SMTP_DATA_TIMEOUT", 0),
+		MaxSessions:         envInt("SMTP_MAX_SESSIONS", 0),
+		MaxSessionsPerIP:    envInt("SMTP_MAX_SESSIONS_PER_IP", 0),
+		ConnectionRateLimit: envRateLimit("SMTP_RATE_LIMIT_CONNECTIONS"),
+		SenderRateLimit:     envRateLimit("SMTP_RATE_LIMIT_SENDER"),
+		RecipientRateLimit:  envRateLimit("SMTP_RATE_LIMIT_RECIPIENT"),
+		EnableFaults:        os.Getenv("SMTP_FAULTS_ENABLED") == "true",
+		ShutdownTimeout:     shutdownTimeout,
+	})
+
+	// Handle graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	slog.Info("Starting SMTP server", "port", port)
-	if err := server.Start(port); err != nil {
+	slog.Info("Starting SMTP server", "port", port, "smtps_port", os.Getenv("SMTPS_PORT"), "http_port", httpPort)
+	if err := server.ListenAndServe(ctx); err != nil {
+		stop()
 		slog.Error("Server error", "error", err)
 		os.Exit(1)
 	}
+	slog.Info("Servers shut down")
 }
 
-func startHealthServer() {
-	mux := http.NewServeMux()
+// envDuration reads a duration such as "30s" from an environment variable,
+// returning fallback when it is unset or invalid
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
 
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"status":"ok","service":"nullmail-smtp"}`))
-	})
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("Invalid duration, using default", "variable", name, "value", value, "default", fallback)
+		return fallback
+	}
+	return parsed
+}
 
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"service":"nullmail-smtp","endpoints":["/health"]}`))
-	})
+// envInt reads an integer from an environment variable, returning fallback
+// when it is unset or invalid
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
 
-	healthPort := os.Getenv("PORT")
-	if healthPort == "" {
-		healthPort = "8080"
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("Invalid number, using default", "variable", name, "value", value, "default", fallback)
+		return fallback
 	}
+	return parsed
+}
 
-	server := &http.Server{
-		Addr:         ":" + healthPort,
-		Handler:      mux,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+// envRateLimit reads a rate limit such as "100/h" from an environment
+// variable. Unset or invalid values disable the limit.
+func envRateLimit(name string) nullmail.RateLimit {
+	limit, err := nullmail.ParseRateLimit(os.Getenv(name))
+	if err != nil {
+		slog.Warn("Invalid rate limit, limit disabled", "variable", name, "error", err)
+		return nullmail.RateLimit{}
 	}
+	return limit
+}
+
+// splitList reads a comma separated list, skipping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
 
-	slog.Info("Starting health check server", "port", healthPort)
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		slog.Error("Health server error", "error", err)
+// parseAuthUsers reads "user:password" pairs separated by commas
+func parseAuthUsers(value string) map[string]string {
+	users := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		username, password, found := strings.Cut(pair, ":")
+		if !found {
+			slog.Warn("Ignoring SMTP_AUTH_USERS entry without password", "user", username)
+			continue
+		}
+		users[username] = password
 	}
+	return users
 }
 
 func initLogger() {
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"nullmail/internal/events"
+)
+
+// keepAliveInterval is how often idle streams are pinged, so that proxies
+// do not close them
+const keepAliveInterval = 30 * time.Second
+
+// handleEvents serves /api/v1/events as server-sent events and
+// /api/v1/events/ws as a WebSocket. Both stream the message.received events
+// of the recipients given with ?recipient=, which is required and may be
+// repeated. There is no unfiltered stream, so that clients cannot list the
+// addresses in use.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if s.events == nil {
+		writeError(w, http.StatusNotFound, "events are disabled")
+		return
+	}
+	if len(r.URL.Query()["recipient"]) == 0 {
+		writeError(w, http.StatusBadRequest, "recipient is required")
+		return
+	}
+
+	parts := splitPath(r.URL.Path, "/api/v1/events")
+	switch {
+	case len(parts) == 0:
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		s.streamEvents(w, r)
+	case len(parts) == 1 && parts[0] == "ws":
+		s.streamEventsWebSocket(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// recipientFilter matches events for any of the ?recipient= addresses
+func recipientFilter(r *http.Request) func(events.Event) bool {
+	recipients := r.URL.Query()["recipient"]
+	return func(event events.Event) bool {
+		for _, recipient := range recipients {
+			if event.HasRecipient(recipient) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	wanted := recipientFilter(r)
+	stream, cancel := s.events.Subscribe()
+	defer cancel()
+
+	controller := http.NewResponseController(w)
+	// The stream outlives the server's write timeout
+	controller.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := controller.Flush(); err != nil {
+		slog.Error("Event stream not supported", "error", err)
+		return
+	}
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		case event, ok := <-stream:
+			if !ok {
+				return
+			}
+			if !wanted(event) {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				slog.Error("Failed to encode event", "error", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\nid: %s\ndata: %s\n\n", event.Type, event.ID, data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// upgrader accepts WebSocket connections from any origin: like the rest of
+// the API the stream is unauthenticated and read-only, and the web client
+// is served from another origin
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// Limits of the WebSocket stream
+const (
+	maxClientMessage      = 4 << 10 // clients have nothing to send
+	websocketWriteTimeout = 10 * time.Second
+)
+
+func (s *Server) streamEventsWebSocket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	wanted := recipientFilter(r)
+	stream, cancel := s.events.Subscribe()
+	defer cancel()
+
+	// Upgrade writes the error response itself
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Debug("WebSocket upgrade failed", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	// Reading handles the client's pings and close frame; anything else
+	// the client sends is discarded
+	conn.SetReadLimit(maxClientMessage)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		var err error
+		select {
+		case <-closed:
+			return
+		case <-s.done:
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+				time.Now().Add(websocketWriteTimeout))
+			return
+		case event, ok := <-stream:
+			if !ok {
+				return
+			}
+			if !wanted(event) {
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+			err = conn.WriteJSON(event)
+		case <-keepAlive.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(websocketWriteTimeout))
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"nullmail/internal/faults"
+)
+
+// maxRuleSize bounds the body of a fault rule request
+const maxRuleSize = 64 << 10
+
+// handleFaults serves /api/v1/faults[/{id}]
+func (s *Server) handleFaults(w http.ResponseWriter, r *http.Request) {
+	if s.faults == nil {
+		writeError(w, http.StatusNotFound, "fault injection is disabled")
+		return
+	}
+
+	parts := splitPath(r.URL.Path, "/api/v1/faults")
+
+	switch len(parts) {
+	case 0:
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, s.faults.List())
+		case http.MethodPost:
+			s.addFault(w, r, "")
+		case http.MethodDelete:
+			s.faults.Clear()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPost, http.MethodDelete)
+		}
+	case 1:
+		switch r.Method {
+		case http.MethodGet:
+			rule, err := s.faults.Get(parts[0])
+			if errors.Is(err, faults.ErrNotFound) {
+				writeError(w, http.StatusNotFound, "fault rule not found")
+				return
+			}
+			writeJSON(w, http.StatusOK, rule)
+		case http.MethodDelete:
+			if err := s.faults.Remove(parts[0]); errors.Is(err, faults.ErrNotFound) {
+				writeError(w, http.StatusNotFound, "fault rule not found")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		}
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// inboxFaults serves /api/v1/inboxes/{address}/faults: the rules that apply
+// to the inbox, and a shortcut to add a rule for it
+func (s *Server) inboxFaults(w http.ResponseWriter, r *http.Request, address string) {
+	if s.faults == nil {
+		writeError(w, http.StatusNotFound, "fault injection is disabled")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rules := []faults.Rule{}
+		for _, rule := range s.faults.List() {
+			if rule.AppliesTo(address) {
+				rules = append(rules, rule)
+			}
+		}
+		writeJSON(w, http.StatusOK, rules)
+	case http.MethodPost:
+		s.addFault(w, r, address)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// addFault adds the rule in the request body. A non-empty recipient
+// overrides the rule's recipient pattern.
+func (s *Server) addFault(w http.ResponseWriter, r *http.Request, recipient string) {
+	var rule faults.Rule
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRuleSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rule); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid fault rule: "+err.Error())
+		return
+	}
+
+	if recipient != "" {
+		rule.Recipient = recipient
+	}
+
+	rule, err := s.faults.Add(rule)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, rule)
+}
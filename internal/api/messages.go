@@ -0,0 +1,319 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"nullmail/internal/email"
+	"nullmail/internal/storage"
+)
+
+type messageList struct {
+	Address  string             `json:"address"`
+	Total    int                `json:"total"`
+	Limit    int                `json:"limit"`
+	Offset   int                `json:"offset"`
+	Messages []*storage.Message `json:"messages"`
+}
+
+// handleInboxes serves /api/v1/inboxes/{address}[/messages|/wait|/faults]
+func (s *Server) handleInboxes(w http.ResponseWriter, r *http.Request) {
+	parts := splitPath(r.URL.Path, "/api/v1/inboxes/")
+
+	switch {
+	case len(parts) == 1:
+		if r.Method != http.MethodDelete {
+			methodNotAllowed(w, http.MethodDelete)
+			return
+		}
+		s.deleteInbox(w, parts[0])
+	case len(parts) == 2 && parts[1] == "messages":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		s.listMessages(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "wait":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		s.waitForMessage(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "faults":
+		s.inboxFaults(w, r, parts[0])
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// handleMessages serves /api/v1/messages/{id}[/raw|/eml|/html|/transcript|/attachments/{index}]
+func (s *Server) handleMessages(w http.ResponseWriter, r *http.Request) {
+	parts := splitPath(r.URL.Path, "/api/v1/messages/")
+
+	switch {
+	case len(parts) == 1:
+		switch r.Method {
+		case http.MethodGet:
+			s.getMessage(w, parts[0])
+		case http.MethodDelete:
+			s.deleteMessage(w, parts[0])
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		}
+	case len(parts) == 2 && parts[1] == "raw":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		s.getRawMessage(w, r, parts[0], false)
+	case len(parts) == 2 && parts[1] == "html":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		s.getHTML(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "eml":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		s.getRawMessage(w, r, parts[0], true)
+	case len(parts) == 2 && parts[1] == "transcript":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		s.getMessageTranscript(w, parts[0])
+	case len(parts) == 3 && parts[1] == "attachments":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		s.getAttachment(w, parts[0], parts[2])
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *Server) listMessages(w http.ResponseWriter, r *http.Request, address string) {
+	limit, offset, err := pagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ids, err := s.store.ListByRecipient(address)
+	if err != nil {
+		slog.Error("Failed to list inbox", "address", address, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to list messages")
+		return
+	}
+
+	list := messageList{
+		Address:  address,
+		Total:    len(ids),
+		Limit:    limit,
+		Offset:   offset,
+		Messages: []*storage.Message{},
+	}
+
+	if offset < len(ids) {
+		end := offset + limit
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		for _, id := range ids[offset:end] {
+			msg, err := s.store.Get(id)
+			if errors.Is(err, storage.ErrNotFound) {
+				// Index entries can outlive expired messages
+				continue
+			} else if err != nil {
+				slog.Error("Failed to load message", "id", id, "error", err)
+				writeError(w, http.StatusInternalServerError, "failed to load messages")
+				return
+			}
+			list.Messages = append(list.Messages, msg)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) deleteInbox(w http.ResponseWriter, address string) {
+	if err := s.store.DeleteInbox(address); err != nil {
+		slog.Error("Failed to delete inbox", "address", address, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to delete inbox")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadMessage fetches a message and writes the error response if it fails
+func (s *Server) loadMessage(w http.ResponseWriter, id string) (*storage.Message, bool) {
+	msg, err := s.store.Get(id)
+	if errors.Is(err, storage.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "message not found")
+		return nil, false
+	} else if err != nil {
+		slog.Error("Failed to load message", "id", id, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to load message")
+		return nil, false
+	}
+	return msg, true
+}
+
+func (s *Server) getMessage(w http.ResponseWriter, id string) {
+	msg, ok := s.loadMessage(w, id)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, msg)
+}
+
+// getRawMessage serves the original message bytes, either for viewing or as
+// a downloadable .eml file. With ?trace=true the Return-Path and Received
+// headers added on delivery are prepended.
+func (s *Server) getRawMessage(w http.ResponseWriter, r *http.Request, id string, download bool) {
+	trace := r.URL.Query().Get("trace")
+	if trace != "" && trace != "true" && trace != "false" {
+		writeError(w, http.StatusBadRequest, "trace must be true or false")
+		return
+	}
+
+	msg, ok := s.loadMessage(w, id)
+	if !ok {
+		return
+	}
+
+	raw, err := s.store.GetRaw(id)
+	if errors.Is(err, storage.ErrNotFound) {
+		// Messages stored before raw content was kept. A reconstruction
+		// would not show the original folding or signatures.
+		writeError(w, http.StatusNotFound, "raw message not kept")
+		return
+	} else if err != nil {
+		slog.Error("Failed to load raw message", "id", id, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to load raw message")
+		return
+	}
+	if trace == "true" {
+		raw = append([]byte(msg.Trace), raw...)
+	}
+
+	if download {
+		w.Header().Set("Content-Type", "message/rfc822")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": id + ".eml"}))
+	} else {
+		w.Header().Set("Content-Type", "text/plain")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(raw)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(raw)
+}
+
+// getHTML serves the HTML body with cid: references resolved. With
+// ?cid=data inline parts are embedded as data URIs, otherwise they are
+// rewritten to attachment download URLs.
+func (s *Server) getHTML(w http.ResponseWriter, r *http.Request, id string) {
+	msg, ok := s.loadMessage(w, id)
+	if !ok {
+		return
+	}
+
+	if msg.Body.HTML == "" {
+		writeError(w, http.StatusNotFound, "message has no HTML body")
+		return
+	}
+
+	mode := r.URL.Query().Get("cid")
+	if mode != "" && mode != "url" && mode != "data" {
+		writeError(w, http.StatusBadRequest, "cid must be url or data")
+		return
+	}
+
+	html := email.ResolveCIDs(msg.Body.HTML, func(contentID string) (string, bool) {
+		index := email.FindInline(msg.Attachments, contentID)
+		if index < 0 {
+			return "", false
+		}
+
+		if mode != "data" {
+			return fmt.Sprintf("/api/v1/messages/%s/attachments/%d", url.PathEscape(id), index), true
+		}
+
+		attachment, err := s.store.GetAttachment(id, index)
+		if err != nil {
+			slog.Warn("Failed to load inline part", "id", id, "content_id", contentID, "error", err)
+			return "", false
+		}
+
+		mediaType, _, err := mime.ParseMediaType(attachment.ContentType)
+		if err != nil {
+			mediaType = "application/octet-stream"
+		}
+		return "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(attachment.Data), true
+	})
+
+	// The body is untrusted; keep scripts and forms from running on the API origin
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(html))
+}
+
+func (s *Server) getAttachment(w http.ResponseWriter, id, indexParam string) {
+	index, err := strconv.Atoi(indexParam)
+	if err != nil || index < 0 {
+		writeError(w, http.StatusBadRequest, "attachment index must be a non-negative integer")
+		return
+	}
+
+	attachment, err := s.store.GetAttachment(id, index)
+	if errors.Is(err, storage.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "attachment not found")
+		return
+	} else if err != nil {
+		slog.Error("Failed to load attachment", "id", id, "index", index, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to load attachment")
+		return
+	}
+
+	contentType := "application/octet-stream"
+	if mediaType, params, err := mime.ParseMediaType(attachment.ContentType); err == nil {
+		contentType = mime.FormatMediaType(mediaType, params)
+	}
+
+	filename := attachment.Filename
+	if filename == "" {
+		filename = fmt.Sprintf("attachment-%d", index)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(attachment.Data)))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.WriteHeader(http.StatusOK)
+	w.Write(attachment.Data)
+}
+
+func (s *Server) deleteMessage(w http.ResponseWriter, id string) {
+	err := s.store.Delete(id)
+	if errors.Is(err, storage.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "message not found")
+		return
+	} else if err != nil {
+		slog.Error("Failed to delete message", "id", id, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to delete message")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"nullmail/internal/events"
+	"nullmail/internal/storage"
+)
+
+func TestGetRawMessage(t *testing.T) {
+	store := storage.NewMemoryStore(0)
+	raw := "Subject: folded\r\n  continued\r\n\r\nbody\r\n"
+	for _, msg := range []*storage.Message{
+		{ID: "kept", Raw: []byte(raw), Trace: "Return-Path: <a@example.com>\r\n", Headers: map[string]string{"Subject": "folded continued"}},
+		{ID: "legacy", Headers: map[string]string{"Subject": "legacy"}},
+	} {
+		if err := store.Save(msg); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+
+	server := NewServer(store, nil, events.NewMemoryBroker())
+	defer server.Close()
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/api/v1/messages/kept/raw", http.StatusOK, raw},
+		{"/api/v1/messages/kept/eml", http.StatusOK, raw},
+		{"/api/v1/messages/kept/raw?trace=true", http.StatusOK, "Return-Path: <a@example.com>\r\n" + raw},
+		{"/api/v1/messages/kept/raw?trace=yes", http.StatusBadRequest, ""},
+		{"/api/v1/messages/legacy/raw", http.StatusNotFound, ""},
+		{"/api/v1/messages/legacy/eml", http.StatusNotFound, ""},
+		{"/api/v1/messages/missing/raw", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if recorder.Code != tt.code {
+				t.Fatalf("status = %d, want %d", recorder.Code, tt.code)
+			}
+			body, _ := io.ReadAll(recorder.Body)
+			if tt.code == http.StatusOK && string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
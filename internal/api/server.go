@@ -0,0 +1,150 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"nullmail/internal/events"
+	"nullmail/internal/faults"
+	"nullmail/internal/storage"
+)
+
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 200
+)
+
+// Server exposes stored inboxes and messages over HTTP
+type Server struct {
+	store  storage.Store
+	faults *faults.Set
+	events events.Broker
+	mux    *http.ServeMux
+
+	done      chan struct{} // closed by Close to end open streams
+	closeOnce sync.Once
+}
+
+// NewServer creates the HTTP API, including the /health endpoint. The fault
+// rules of the SMTP server are managed through faultSet, and broker feeds
+// the event streams. The corresponding endpoints answer 404 when either is
+// nil.
+func NewServer(store storage.Store, faultSet *faults.Set, broker events.Broker) *Server {
+	s := &Server{
+		store:  store,
+		faults: faultSet,
+		events: broker,
+		mux:    http.NewServeMux(),
+		done:   make(chan struct{}),
+	}
+
+	s.mux.HandleFunc("/health", s.handleHealth)
+	s.mux.HandleFunc("/api/v1/inboxes/", s.handleInboxes)
+	s.mux.HandleFunc("/api/v1/messages/", s.handleMessages)
+	s.mux.HandleFunc("/api/v1/sessions/", s.handleSessions)
+	s.mux.HandleFunc("/api/v1/faults", s.handleFaults)
+	s.mux.HandleFunc("/api/v1/faults/", s.handleFaults)
+	s.mux.HandleFunc("/api/v1/events", s.handleEvents)
+	s.mux.HandleFunc("/api/v1/events/", s.handleEvents)
+	s.mux.HandleFunc("/", s.handleIndex)
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Close ends open event streams. http.Server.Shutdown does not interrupt
+// active requests, so call it first.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "service": "nullmail-smtp"})
+}
+
+func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"service": "nullmail-smtp",
+		"endpoints": []string{
+			"/health",
+			"GET /api/v1/inboxes/{address}/messages",
+			"GET /api/v1/inboxes/{address}/wait?subject~=&from~=&since=&timeout=30s",
+			"DELETE /api/v1/inboxes/{address}",
+			"GET|POST /api/v1/inboxes/{address}/faults",
+			"GET /api/v1/messages/{id}",
+			"GET /api/v1/messages/{id}/raw",
+			"GET /api/v1/messages/{id}/eml",
+			"GET /api/v1/messages/{id}/html?cid=url|data",
+			"GET /api/v1/messages/{id}/attachments/{index}",
+			"GET /api/v1/messages/{id}/transcript",
+			"DELETE /api/v1/messages/{id}",
+			"GET /api/v1/sessions/{id}/transcript",
+			"GET|POST|DELETE /api/v1/faults",
+			"GET|DELETE /api/v1/faults/{id}",
+			"GET /api/v1/events?recipient={address}",
+			"GET /api/v1/events/ws?recipient={address}",
+		},
+	})
+}
+
+// splitPath returns the path segments following prefix
+func splitPath(path, prefix string) []string {
+	rest := strings.Trim(strings.TrimPrefix(path, prefix), "/")
+	if rest == "" {
+		return nil
+	}
+	return strings.Split(rest, "/")
+}
+
+// pagination reads limit and offset query parameters
+func pagination(r *http.Request) (limit, offset int, err error) {
+	limit = DefaultPageLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return 0, 0, errors.New("limit must be a positive integer")
+		}
+		if limit > MaxPageLimit {
+			limit = MaxPageLimit
+		}
+	}
+
+	if value := r.URL.Query().Get("offset"); value != "" {
+		offset, err = strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("offset must be a non-negative integer")
+		}
+	}
+
+	return limit, offset, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to encode API response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"nullmail/internal/storage"
+)
+
+// handleSessions serves /api/v1/sessions/{id}/transcript
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	parts := splitPath(r.URL.Path, "/api/v1/sessions/")
+
+	if len(parts) != 2 || parts[1] != "transcript" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	s.getTranscript(w, parts[0])
+}
+
+// getMessageTranscript serves the transcript of the session that delivered
+// a message
+func (s *Server) getMessageTranscript(w http.ResponseWriter, id string) {
+	msg, ok := s.loadMessage(w, id)
+	if !ok {
+		return
+	}
+
+	if msg.Envelope == nil || msg.Envelope.SessionID == "" {
+		writeError(w, http.StatusNotFound, "message has no session transcript")
+		return
+	}
+	s.getTranscript(w, msg.Envelope.SessionID)
+}
+
+func (s *Server) getTranscript(w http.ResponseWriter, sessionID string) {
+	transcript, err := s.store.GetTranscript(sessionID)
+	if errors.Is(err, storage.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "transcript not found")
+		return
+	} else if err != nil {
+		slog.Error("Failed to load transcript", "session", sessionID, "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to load transcript")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, transcript)
+}
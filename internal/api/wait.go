@@ -0,0 +1,191 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+
+	"nullmail/internal/events"
+	"nullmail/internal/storage"
+)
+
+// Limits of the wait endpoint's timeout parameter
+const (
+	DefaultWaitTimeout = 30 * time.Second
+	MaxWaitTimeout     = 5 * time.Minute
+)
+
+// How often a wait request checks the inbox without being signalled. With
+// an event broker this only covers events lost while Redis is unavailable.
+const (
+	waitPollInterval   = 500 * time.Millisecond
+	waitRecoveryPeriod = 5 * time.Second
+)
+
+// messageQuery selects the messages a wait request is waiting for
+type messageQuery struct {
+	subject *regexp.Regexp
+	from    *regexp.Regexp
+	since   time.Time
+}
+
+// parseMessageQuery reads the subject~ and from~ regular expressions and
+// the since timestamp. All of them are optional.
+func parseMessageQuery(r *http.Request) (messageQuery, error) {
+	var query messageQuery
+	values := r.URL.Query()
+
+	for _, param := range []struct {
+		name   string
+		target **regexp.Regexp
+	}{
+		{"subject~", &query.subject},
+		{"from~", &query.from},
+	} {
+		if value := values.Get(param.name); value != "" {
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return messageQuery{}, fmt.Errorf("%s must be a regular expression: %v", param.name, err)
+			}
+			*param.target = re
+		}
+	}
+
+	if value := values.Get("since"); value != "" {
+		since, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return messageQuery{}, errors.New("since must be an RFC 3339 timestamp")
+		}
+		query.since = since
+	}
+
+	return query, nil
+}
+
+func (q messageQuery) matches(msg *storage.Message) bool {
+	if q.subject != nil && !q.subject.MatchString(msg.Subject) {
+		return false
+	}
+	if q.from != nil && !q.from.MatchString(msg.From) {
+		return false
+	}
+	return q.since.IsZero() || !msg.ReceivedAt.Before(q.since)
+}
+
+// waitTimeout reads the timeout parameter
+func waitTimeout(r *http.Request) (time.Duration, error) {
+	value := r.URL.Query().Get("timeout")
+	if value == "" {
+		return DefaultWaitTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 || timeout > MaxWaitTimeout {
+		return 0, fmt.Errorf("timeout must be a duration between 0 and %s", MaxWaitTimeout)
+	}
+	return timeout, nil
+}
+
+// waitForMessage blocks until a message matching the query is in the
+// inbox, including messages stored before the request, and returns the
+// newest one. It answers 408 if none arrives within the timeout.
+func (s *Server) waitForMessage(w http.ResponseWriter, r *http.Request, address string) {
+	query, err := parseMessageQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	timeout, err := waitTimeout(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// The request may outlast the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + 10*time.Second))
+
+	// Subscribe before the first look at the inbox, so that a message
+	// stored in between is not missed
+	var arrivals <-chan events.Event
+	pollInterval := waitPollInterval
+	if s.events != nil {
+		stream, cancel := s.events.Subscribe()
+		defer cancel()
+		arrivals = stream
+		pollInterval = waitRecoveryPeriod
+	}
+	poll := time.NewTicker(pollInterval)
+	defer poll.Stop()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	checked := make(map[string]bool)
+	for {
+		msg, err := s.findMessage(address, query, checked)
+		if err != nil {
+			slog.Error("Failed to search inbox", "address", address, "error", err)
+			writeError(w, http.StatusInternalServerError, "failed to search inbox")
+			return
+		}
+		if msg != nil {
+			writeJSON(w, http.StatusOK, msg)
+			return
+		}
+
+	wait:
+		for {
+			select {
+			case <-deadline.C:
+				writeError(w, http.StatusRequestTimeout, "no matching message before timeout")
+				return
+			case <-r.Context().Done():
+				return
+			case <-s.done:
+				writeError(w, http.StatusServiceUnavailable, "server shutting down")
+				return
+			case <-poll.C:
+				break wait
+			case event, ok := <-arrivals:
+				if !ok {
+					return
+				}
+				if event.HasRecipient(address) {
+					break wait
+				}
+			}
+		}
+	}
+}
+
+// findMessage returns the newest message in the inbox that matches query,
+// or nil. Messages already in checked are skipped, and every message
+// loaded is added to it, so each one is only examined once.
+func (s *Server) findMessage(address string, query messageQuery, checked map[string]bool) (*storage.Message, error) {
+	ids, err := s.store.ListByRecipient(address)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		if checked[id] {
+			continue
+		}
+		checked[id] = true
+
+		msg, err := s.store.Get(id)
+		if errors.Is(err, storage.ErrNotFound) {
+			// Index entries can outlive expired messages
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if query.matches(msg) {
+			return msg, nil
+		}
+	}
+	return nil, nil
+}
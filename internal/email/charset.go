@@ -0,0 +1,45 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+)
+
+// decodeCharset converts text in the declared charset to UTF-8. Unknown or
+// missing charsets are passed through with invalid sequences replaced, so the
+// result is always valid UTF-8.
+func decodeCharset(content []byte, charset string) (string, error) {
+	charset = strings.ToLower(strings.TrimSpace(charset))
+
+	switch charset {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return string(bytes.ToValidUTF8(content, []byte(string(utf8.RuneError)))), nil
+	}
+
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return string(bytes.ToValidUTF8(content, []byte(string(utf8.RuneError)))), fmt.Errorf("unsupported charset %q", charset)
+	}
+
+	decoded, _, err := transform.Bytes(enc.NewDecoder(), content)
+	if err != nil {
+		return string(bytes.ToValidUTF8(content, []byte(string(utf8.RuneError)))), fmt.Errorf("failed to decode %s: %w", charset, err)
+	}
+	return string(decoded), nil
+}
+
+// charsetReader lets mime.WordDecoder handle encoded words in any charset
+// known to decodeCharset
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %q", charset)
+	}
+	return transform.NewReader(input, enc.NewDecoder()), nil
+}
@@ -0,0 +1,38 @@
+package email
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// cidRegex matches cid: URLs inside HTML attributes and CSS url() values
+var cidRegex = regexp.MustCompile(`(?i)cid:([^"'\s)>]+)`)
+
+// ResolveCIDs rewrites cid: references in an HTML body. resolve is called
+// with each Content-ID and returns the replacement URL, or false to leave the
+// reference untouched.
+func ResolveCIDs(html string, resolve func(contentID string) (string, bool)) string {
+	return cidRegex.ReplaceAllStringFunc(html, func(match string) string {
+		contentID := match[len("cid:"):]
+		if unescaped, err := url.PathUnescape(contentID); err == nil {
+			contentID = unescaped
+		}
+
+		if replacement, ok := resolve(strings.Trim(contentID, "<>")); ok {
+			return replacement
+		}
+		return match
+	})
+}
+
+// FindInline returns the index of the inline attachment with the given
+// Content-ID, or -1
+func FindInline(attachments []Attachment, contentID string) int {
+	for i, attachment := range attachments {
+		if attachment.ContentID != "" && strings.EqualFold(attachment.ContentID, contentID) {
+			return i
+		}
+	}
+	return -1
+}
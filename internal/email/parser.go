@@ -10,6 +10,7 @@ import (
 	"mime/multipart"
 	"mime/quotedprintable"
 	"net/mail"
+	"net/textproto"
 	"regexp"
 	"strings"
 	"time"
@@ -19,6 +20,7 @@ import (
 type EmailParser struct {
 	MaxSize        int64
 	MaxAttachments int
+	MaxDepth       int // Maximum multipart nesting
 	AllowUTF8      bool
 }
 
@@ -26,18 +28,20 @@ func NewEmailParser() *EmailParser {
 	return &EmailParser{
 		MaxSize:        25 * 1024 * 1024, // 25MB
 		MaxAttachments: 10,
+		MaxDepth:       20,
 		AllowUTF8:      true,
 	}
 }
 
-// ParseEmail parses a raw email message
-func (p *EmailParser) ParseEmail(rawEmail string) (*ParseResult, error) {
+// ParseEmail parses a raw email message. The input may contain 8-bit data in
+// any charset; text bodies are decoded to UTF-8 using their declared charset.
+func (p *EmailParser) ParseEmail(rawEmail []byte) (*ParseResult, error) {
 	result := &ParseResult{
 		Email:  &Email{},
 		Errors: []ValidationError{},
 	}
 
-	if rawEmail == "" {
+	if len(rawEmail) == 0 {
 		result.addError("email", "Email content cannot be empty", "")
 		return result, nil
 	}
@@ -47,23 +51,20 @@ func (p *EmailParser) ParseEmail(rawEmail string) (*ParseResult, error) {
 		return result, nil
 	}
 
-	if !utf8.ValidString(rawEmail) {
-		result.addError("email", "Invalid UTF-8 encoding in email", "")
-		return result, nil
-	}
+	// Identify the message even if its structure cannot be parsed, so the
+	// original bytes can still be stored and inspected
+	result.Email.ID = p.generateEmailID()
+	result.Email.ReceivedAt = time.Now()
+	result.Email.Size = int64(len(rawEmail))
+	result.Email.IsUTF8 = !isASCII(string(rawEmail))
 
-	reader := strings.NewReader(rawEmail)
+	reader := bytes.NewReader(rawEmail)
 	msg, err := mail.ReadMessage(reader)
 	if err != nil {
 		result.addError("email", "Failed to parse email: "+err.Error(), "")
 		return result, nil
 	}
 
-	result.Email.ID = p.generateEmailID()
-	result.Email.ReceivedAt = time.Now()
-	result.Email.Size = int64(len(rawEmail))
-	result.Email.IsUTF8 = !isASCII(rawEmail)
-
 	result.Email.Headers = make(map[string]string)
 	for key, values := range msg.Header {
 		result.Email.Headers[key] = strings.Join(values, ", ")
@@ -125,7 +126,25 @@ func (p *EmailParser) parseStandardHeaders(headers mail.Header, result *ParseRes
 }
 
 func (p *EmailParser) parseBody(msg *mail.Message, result *ParseResult) {
-	contentType := msg.Header.Get("Content-Type")
+	bodyBytes, err := io.ReadAll(msg.Body)
+	if err != nil {
+		result.addError("body", "Failed to read body: "+err.Error(), "")
+		return
+	}
+
+	result.Email.Body.Raw = string(bodyBytes)
+
+	root := p.parseEntity(textproto.MIMEHeader(msg.Header), bodyBytes, 0, result)
+	p.selectBody(root, true, result)
+	root.release()
+
+	result.Email.Parts = root
+}
+
+// parseEntity builds the MIME tree rooted at an entity, decoding leaf content
+// and collecting attachments along the way
+func (p *EmailParser) parseEntity(header textproto.MIMEHeader, body []byte, depth int, result *ParseResult) *MIMEPart {
+	contentType := header.Get("Content-Type")
 	if contentType == "" {
 		contentType = "text/plain"
 	}
@@ -136,38 +155,67 @@ func (p *EmailParser) parseBody(msg *mail.Message, result *ParseResult) {
 		mediaType = "text/plain"
 	}
 
-	bodyBytes, err := io.ReadAll(msg.Body)
-	if err != nil {
-		result.addError("body", "Failed to read body: "+err.Error(), "")
-		return
+	node := &MIMEPart{
+		ContentType: mediaType,
+		Charset:     params["charset"],
+		Headers:     make(map[string]string),
 	}
 
-	result.Email.Body.Raw = string(bodyBytes)
+	for key, values := range header {
+		node.Headers[key] = strings.Join(values, ", ")
+	}
 
-	switch {
-	case strings.HasPrefix(mediaType, "multipart/"):
-		p.parseMultipartBody(bodyBytes, params, result)
-	case mediaType == "text/plain":
-		result.Email.Body.Text = string(bodyBytes)
-	case mediaType == "text/html":
-		result.Email.Body.HTML = string(bodyBytes)
-	default:
-		// Treat as plain text for unknown types
-		result.Email.Body.Text = string(bodyBytes)
+	if disposition := header.Get("Content-Disposition"); disposition != "" {
+		dispositionType, dispositionParams, err := mime.ParseMediaType(disposition)
+		if err == nil {
+			node.Disposition = dispositionType
+			node.Filename = dispositionParams["filename"]
+		}
 	}
+	if node.Filename == "" {
+		node.Filename = params["name"]
+	}
+
+	node.ContentID = strings.Trim(strings.TrimSpace(header.Get("Content-Id")), "<>")
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		p.parseMultipart(node, body, params, depth, result)
+		return node
+	}
+
+	content := body
+	if encoding := header.Get("Content-Transfer-Encoding"); encoding != "" {
+		content = p.decodeContent(content, encoding)
+	}
+	node.Size = int64(len(content))
+	node.content = content
+
+	if node.isAttachment() {
+		p.parseAttachment(node, header, content, result)
+	}
+
+	return node
 }
 
-func (p *EmailParser) parseMultipartBody(bodyBytes []byte, params map[string]string, result *ParseResult) {
+// parseMultipart parses the children of a multipart entity recursively
+func (p *EmailParser) parseMultipart(node *MIMEPart, body []byte, params map[string]string, depth int, result *ParseResult) {
 	boundary := params["boundary"]
 	if boundary == "" {
 		result.addError("body", "Missing boundary in multipart message", "")
 		return
 	}
 
-	reader := multipart.NewReader(bytes.NewReader(bodyBytes), boundary)
+	if depth >= p.MaxDepth {
+		result.addError("body", fmt.Sprintf("MIME nesting too deep (max %d levels)", p.MaxDepth), "")
+		return
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
 
 	for {
-		part, err := reader.NextPart()
+		// NextRawPart keeps Content-Transfer-Encoding so every part is
+		// decoded the same way
+		part, err := reader.NextRawPart()
 		if err == io.EOF {
 			break
 		}
@@ -176,98 +224,80 @@ func (p *EmailParser) parseMultipartBody(bodyBytes []byte, params map[string]str
 			break
 		}
 
-		p.parseMultipartPart(part, result)
+		content, err := io.ReadAll(part)
 		part.Close()
-
-		// Limit number of attachments
-		if len(result.Email.Attachments) >= p.MaxAttachments {
-			result.addError("attachments", fmt.Sprintf("Too many attachments (max %d)", p.MaxAttachments), "")
+		if err != nil {
+			result.addError("body", "Failed to read part content: "+err.Error(), "")
 			break
 		}
-	}
-}
-
-func (p *EmailParser) parseMultipartPart(part *multipart.Part, result *ParseResult) {
-	contentType := part.Header.Get("Content-Type")
-	if contentType == "" {
-		contentType = "text/plain"
-	}
 
-	mediaType, _, err := mime.ParseMediaType(contentType)
-	if err != nil {
-		mediaType = "text/plain"
+		child := p.parseEntity(part.Header, content, depth+1, result)
+		node.Parts = append(node.Parts, child)
+		node.Size += child.Size
 	}
+}
 
-	// Read part content
-	content, err := io.ReadAll(part)
-	if err != nil {
-		result.addError("body", "Failed to read part content: "+err.Error(), "")
+// selectBody fills Body.Text and Body.HTML from the first matching inline
+// text parts. Alternatives are listed in increasing order of preference, so
+// they are searched last to first.
+func (p *EmailParser) selectBody(node *MIMEPart, root bool, result *ParseResult) {
+	if strings.HasPrefix(node.ContentType, "multipart/") {
+		if node.ContentType == "multipart/alternative" {
+			for i := len(node.Parts) - 1; i >= 0; i-- {
+				p.selectBody(node.Parts[i], false, result)
+			}
+		} else {
+			for _, child := range node.Parts {
+				p.selectBody(child, false, result)
+			}
+		}
 		return
 	}
 
-	// Decode if needed
-	encoding := part.Header.Get("Content-Transfer-Encoding")
-	if encoding != "" {
-		content = p.decodeContent(content, encoding)
+	if node.isAttachment() {
+		return
 	}
 
-	// Handle based on content type and disposition
-	disposition := part.Header.Get("Content-Disposition")
-
-	if disposition != "" && strings.HasPrefix(disposition, "attachment") {
-		// This is an attachment
-		p.parseAttachment(part, content, result)
-	} else {
-		// This is body content
-		switch mediaType {
-		case "text/plain":
-			if result.Email.Body.Text == "" {
-				result.Email.Body.Text = string(content)
-			}
-		case "text/html":
-			if result.Email.Body.HTML == "" {
-				result.Email.Body.HTML = string(content)
-			}
+	switch {
+	case node.ContentType == "text/html":
+		if result.Email.Body.HTML == "" {
+			result.Email.Body.HTML = p.decodeText(node.content, node.Charset, result)
+		}
+	case node.ContentType == "text/plain", root:
+		// A single-part message of unknown type is shown as plain text
+		if result.Email.Body.Text == "" {
+			result.Email.Body.Text = p.decodeText(node.content, node.Charset, result)
 		}
 	}
 }
 
-// parseAttachment parses an email attachment
-func (p *EmailParser) parseAttachment(part *multipart.Part, content []byte, result *ParseResult) {
-	attachment := Attachment{
-		Data:        content,
-		Size:        int64(len(content)),
-		ContentType: part.Header.Get("Content-Type"),
-		Headers:     make(map[string]string),
-	}
-
-	// Copy headers
-	for key, values := range part.Header {
-		attachment.Headers[key] = strings.Join(values, ", ")
+// decodeText converts a text part to UTF-8, recording a warning if the
+// charset could not be decoded
+func (p *EmailParser) decodeText(content []byte, charset string, result *ParseResult) string {
+	text, err := decodeCharset(content, charset)
+	if err != nil {
+		result.addError("body", err.Error(), charset)
 	}
+	return text
+}
 
-	// Extract filename
-	disposition := part.Header.Get("Content-Disposition")
-	if disposition != "" {
-		_, params, err := mime.ParseMediaType(disposition)
-		if err == nil {
-			if filename, ok := params["filename"]; ok {
-				attachment.Filename = filename
-			}
+// parseAttachment records a leaf part as an attachment
+func (p *EmailParser) parseAttachment(node *MIMEPart, header textproto.MIMEHeader, content []byte, result *ParseResult) {
+	if len(result.Email.Attachments) >= p.MaxAttachments {
+		if len(result.Email.Attachments) == p.MaxAttachments {
+			result.addError("attachments", fmt.Sprintf("Too many attachments (max %d)", p.MaxAttachments), "")
 		}
+		return
 	}
 
-	// Try to get filename from Content-Type if not found
-	if attachment.Filename == "" {
-		contentType := part.Header.Get("Content-Type")
-		if contentType != "" {
-			_, params, err := mime.ParseMediaType(contentType)
-			if err == nil {
-				if name, ok := params["name"]; ok {
-					attachment.Filename = name
-				}
-			}
-		}
+	attachment := Attachment{
+		Filename:    node.Filename,
+		ContentID:   node.ContentID,
+		Inline:      node.isInline(),
+		Data:        content,
+		Size:        int64(len(content)),
+		ContentType: header.Get("Content-Type"),
+		Headers:     node.Headers,
 	}
 
 	result.Email.Attachments = append(result.Email.Attachments, attachment)
@@ -295,7 +325,7 @@ func (p *EmailParser) decodeContent(content []byte, encoding string) []byte {
 
 // decodeHeader decodes MIME-encoded headers
 func (p *EmailParser) decodeHeader(header string) (string, error) {
-	dec := new(mime.WordDecoder)
+	dec := &mime.WordDecoder{CharsetReader: charsetReader}
 	return dec.DecodeHeader(header)
 }
 
@@ -0,0 +1,262 @@
+package email
+
+import (
+	"strings"
+	"testing"
+)
+
+// shape renders a MIME tree as "type(child,child)" for comparison
+func shape(part *MIMEPart) string {
+	if part == nil {
+		return ""
+	}
+	if len(part.Parts) == 0 {
+		return part.ContentType
+	}
+
+	children := make([]string, 0, len(part.Parts))
+	for _, child := range part.Parts {
+		children = append(children, shape(child))
+	}
+	return part.ContentType + "(" + strings.Join(children, ",") + ")"
+}
+
+// message joins header and body lines with CRLF
+func message(lines ...string) []byte {
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func TestParseEmailMIMETree(t *testing.T) {
+	tests := []struct {
+		name        string
+		raw         []byte
+		shape       string
+		text        string
+		html        string
+		attachments []string // filenames, with "inline:" for inline parts
+	}{
+		{
+			name: "single part",
+			raw: message(
+				"Subject: plain",
+				"",
+				"hello",
+			),
+			shape: "text/plain",
+			text:  "hello\r\n",
+		},
+		{
+			name: "unknown single part type is shown as text",
+			raw: message(
+				"Content-Type: text/x-custom",
+				"",
+				"custom",
+			),
+			shape: "text/x-custom",
+			text:  "custom\r\n",
+		},
+		{
+			name: "alternative prefers the last part of each type",
+			raw: message(
+				`Content-Type: multipart/alternative; boundary="alt"`,
+				"",
+				"--alt",
+				"Content-Type: text/plain",
+				"",
+				"plain",
+				"--alt",
+				"Content-Type: text/html",
+				"",
+				"<p>html</p>",
+				"--alt--",
+			),
+			shape: "multipart/alternative(text/plain,text/html)",
+			text:  "plain",
+			html:  "<p>html</p>",
+		},
+		{
+			name: "nested related with inline image and attachment",
+			raw: message(
+				`Content-Type: multipart/mixed; boundary="mixed"`,
+				"",
+				"--mixed",
+				`Content-Type: multipart/alternative; boundary="alt"`,
+				"",
+				"--alt",
+				"Content-Type: text/plain",
+				"",
+				"plain",
+				"--alt",
+				`Content-Type: multipart/related; boundary="rel"`,
+				"",
+				"--rel",
+				"Content-Type: text/html",
+				"",
+				`<img src="cid:logo">`,
+				"--rel",
+				"Content-Type: image/png",
+				"Content-ID: <logo>",
+				"Content-Transfer-Encoding: base64",
+				"",
+				"iVBORw0KGgo=",
+				"--rel--",
+				"--alt--",
+				"--mixed",
+				`Content-Type: application/pdf; name="report.pdf"`,
+				"Content-Disposition: attachment; filename=\"report.pdf\"",
+				"Content-Transfer-Encoding: base64",
+				"",
+				"JVBERi0=",
+				"--mixed--",
+			),
+			shape:       "multipart/mixed(multipart/alternative(text/plain,multipart/related(text/html,image/png)),application/pdf)",
+			text:        "plain",
+			html:        `<img src="cid:logo">`,
+			attachments: []string{"inline:", "report.pdf"},
+		},
+		{
+			name: "text part with attachment disposition is not the body",
+			raw: message(
+				`Content-Type: multipart/mixed; boundary="b"`,
+				"",
+				"--b",
+				"Content-Type: text/plain",
+				"",
+				"body",
+				"--b",
+				"Content-Type: text/plain",
+				`Content-Disposition: attachment; filename="notes.txt"`,
+				"",
+				"notes",
+				"--b--",
+			),
+			shape:       "multipart/mixed(text/plain,text/plain)",
+			text:        "body",
+			attachments: []string{"notes.txt"},
+		},
+		{
+			name: "quoted-printable and charset are decoded",
+			raw: message(
+				`Content-Type: text/plain; charset="iso-8859-1"`,
+				"Content-Transfer-Encoding: quoted-printable",
+				"",
+				"caf=E9",
+			),
+			shape: "text/plain",
+			text:  "café\r\n",
+		},
+		{
+			name: "multipart without boundary keeps the node",
+			raw: message(
+				"Content-Type: multipart/mixed",
+				"",
+				"no parts",
+			),
+			shape: "multipart/mixed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := NewEmailParser().ParseEmail(tt.raw)
+			if err != nil {
+				t.Fatalf("ParseEmail: %v", err)
+			}
+			parsed := result.Email
+
+			if got := shape(parsed.Parts); got != tt.shape {
+				t.Errorf("tree = %s, want %s", got, tt.shape)
+			}
+			if parsed.Body.Text != tt.text {
+				t.Errorf("text = %q, want %q", parsed.Body.Text, tt.text)
+			}
+			if parsed.Body.HTML != tt.html {
+				t.Errorf("html = %q, want %q", parsed.Body.HTML, tt.html)
+			}
+
+			var attachments []string
+			for _, attachment := range parsed.Attachments {
+				name := attachment.Filename
+				if attachment.Inline {
+					name = "inline:" + name
+				}
+				attachments = append(attachments, name)
+			}
+			if strings.Join(attachments, ";") != strings.Join(tt.attachments, ";") {
+				t.Errorf("attachments = %q, want %q", attachments, tt.attachments)
+			}
+		})
+	}
+}
+
+func TestParseEmailMaxDepth(t *testing.T) {
+	parser := NewEmailParser()
+	parser.MaxDepth = 2
+
+	// Three levels of nesting, one more than allowed
+	raw := message(
+		`Content-Type: multipart/mixed; boundary="l0"`,
+		"",
+		"--l0",
+		`Content-Type: multipart/mixed; boundary="l1"`,
+		"",
+		"--l1",
+		`Content-Type: multipart/mixed; boundary="l2"`,
+		"",
+		"--l2",
+		"Content-Type: text/plain",
+		"",
+		"deep",
+		"--l2--",
+		"--l1--",
+		"--l0--",
+	)
+
+	result, err := parser.ParseEmail(raw)
+	if err != nil {
+		t.Fatalf("ParseEmail: %v", err)
+	}
+	if got, want := shape(result.Email.Parts), "multipart/mixed(multipart/mixed(multipart/mixed))"; got != want {
+		t.Errorf("tree = %s, want %s", got, want)
+	}
+	if len(result.Errors) == 0 {
+		t.Error("no error recorded for nesting beyond MaxDepth")
+	}
+}
+
+func TestParseEmailSizes(t *testing.T) {
+	raw := message(
+		`Content-Type: multipart/mixed; boundary="b"`,
+		"",
+		"--b",
+		"Content-Type: text/plain",
+		"",
+		"12345",
+		"--b",
+		"Content-Type: application/octet-stream",
+		`Content-Disposition: attachment; filename="data.bin"`,
+		"Content-Transfer-Encoding: base64",
+		"",
+		"AAECAw==",
+		"--b--",
+	)
+
+	result, err := NewEmailParser().ParseEmail(raw)
+	if err != nil {
+		t.Fatalf("ParseEmail: %v", err)
+	}
+
+	root := result.Email.Parts
+	if len(root.Parts) != 2 {
+		t.Fatalf("root has %d parts, want 2", len(root.Parts))
+	}
+	if got := root.Parts[1].Size; got != 4 {
+		t.Errorf("decoded attachment size = %d, want 4", got)
+	}
+	if got, want := root.Size, root.Parts[0].Size+root.Parts[1].Size; got != want {
+		t.Errorf("multipart size = %d, want the sum of its children %d", got, want)
+	}
+	if len(result.Email.Attachments) != 1 || len(result.Email.Attachments[0].Data) != 4 {
+		t.Errorf("attachments = %+v, want one of 4 bytes", result.Email.Attachments)
+	}
+}
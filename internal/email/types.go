@@ -15,6 +15,7 @@ type Email struct {
 	Body        EmailBody         `json:"body"`
 	Headers     map[string]string `json:"headers"`
 	Attachments []Attachment      `json:"attachments,omitempty"`
+	Parts       *MIMEPart         `json:"parts,omitempty"` // MIME tree, rooted at the message itself
 	ReceivedAt  time.Time         `json:"received_at"`
 	Size        int64             `json:"size"`
 	IsUTF8      bool              `json:"is_utf8"`
@@ -29,11 +30,60 @@ type EmailBody struct {
 type Attachment struct {
 	Filename    string            `json:"filename"`
 	ContentType string            `json:"content_type"`
+	ContentID   string            `json:"content_id,omitempty"` // Without angle brackets
+	Inline      bool              `json:"inline,omitempty"`     // Referenced from the HTML body via cid:
 	Size        int64             `json:"size"`
 	Data        []byte            `json:"-"` // Don't serialize binary data in JSON
 	Headers     map[string]string `json:"headers,omitempty"`
 }
 
+// MIMEPart is a node of a message's MIME tree
+type MIMEPart struct {
+	ContentType string            `json:"content_type"`
+	Charset     string            `json:"charset,omitempty"`
+	Disposition string            `json:"disposition,omitempty"`
+	Filename    string            `json:"filename,omitempty"`
+	ContentID   string            `json:"content_id,omitempty"`
+	Size        int64             `json:"size"` // Decoded size; for multiparts the sum of all children
+	Headers     map[string]string `json:"headers,omitempty"`
+	Parts       []*MIMEPart       `json:"parts,omitempty"`
+
+	content []byte // decoded leaf content, only kept while parsing
+}
+
+// isAttachment reports whether a leaf part is downloadable content rather
+// than a body. Inline parts are included.
+func (m *MIMEPart) isAttachment() bool {
+	if m.Disposition == "attachment" {
+		return true
+	}
+
+	// Non-text leaves that carry a filename are attachments even without an
+	// explicit disposition
+	return m.isInline() || (m.Disposition == "" && !m.isText() && m.Filename != "")
+}
+
+// isInline reports whether a leaf part is embedded content, such as an image
+// referenced from the HTML body by its Content-ID
+func (m *MIMEPart) isInline() bool {
+	if m.isText() || m.Disposition == "attachment" {
+		return false
+	}
+	return m.Disposition == "inline" || m.ContentID != ""
+}
+
+func (m *MIMEPart) isText() bool {
+	return m.ContentType == "text/plain" || m.ContentType == "text/html"
+}
+
+// release drops decoded content held by the tree once parsing is done
+func (m *MIMEPart) release() {
+	m.content = nil
+	for _, child := range m.Parts {
+		child.release()
+	}
+}
+
 type ValidationError struct {
 	Field   string `json:"field"`
 	Message string `json:"message"`
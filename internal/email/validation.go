@@ -28,7 +28,6 @@ type EmailValidator struct {
 	MaxTotalLength  int
 	RequireTLD      bool
 	AllowIPDomains  bool
-	ValidDomains    []string // Whitelist of allowed domains
 	InvalidDomains  []string // Blacklist of forbidden domains
 }
 
@@ -41,7 +40,6 @@ func NewEmailValidator() *EmailValidator {
 		MaxTotalLength:  320, // RFC 5321 limit (64 + 1 + 255)
 		RequireTLD:      true,
 		AllowIPDomains:  false,
-		ValidDomains:    []string{},
 		InvalidDomains:  []string{},
 	}
 }
@@ -196,19 +194,6 @@ func (v *EmailValidator) checkDomainPolicy(domain string, result *ValidationResu
 			return
 		}
 	}
-
-	if len(v.ValidDomains) > 0 {
-		allowed := false
-		for _, valid := range v.ValidDomains {
-			if strings.EqualFold(domain, valid) {
-				allowed = true
-				break
-			}
-		}
-		if !allowed {
-			result.addError("domain", "Domain is not in allowed list", domain)
-		}
-	}
 }
 
 func (v *EmailValidator) ParseEmailAddress(address string) (*EmailAddress, error) {
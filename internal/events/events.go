@@ -0,0 +1,46 @@
+// Package events broadcasts notifications about received mail, either
+// within the process or through Redis pub/sub so that every replica sees
+// the mail received by the others.
+package events
+
+import (
+	"strings"
+	"time"
+)
+
+// TypeMessageReceived is sent once a message has been stored
+const TypeMessageReceived = "message.received"
+
+// Event describes a stored message. Clients fetch the message itself
+// through the API.
+type Event struct {
+	Type       string    `json:"type"`
+	ID         string    `json:"id"`
+	From       string    `json:"from"`
+	Recipients []string  `json:"recipients"`
+	Subject    string    `json:"subject"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// HasRecipient reports whether address is one of the envelope recipients,
+// ignoring case
+func (e Event) HasRecipient(address string) bool {
+	for _, recipient := range e.Recipients {
+		if strings.EqualFold(recipient, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// Broker delivers published events to every subscriber
+type Broker interface {
+	// Publish sends an event to current subscribers. It does not wait
+	// for them to receive it.
+	Publish(event Event) error
+
+	// Subscribe returns the events published from now on. Events are
+	// dropped for a subscriber that falls behind. The channel is closed
+	// once cancel is called.
+	Subscribe() (events <-chan Event, cancel func())
+}
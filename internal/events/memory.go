@@ -0,0 +1,54 @@
+package events
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// subscriberBuffer is how many events a subscriber can fall behind
+const subscriberBuffer = 64
+
+// MemoryBroker delivers events within one process
+type MemoryBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+func (b *MemoryBroker) Publish(event Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			slog.Warn("Dropping event for slow subscriber", "type", event.Type, "id", event.ID)
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+	return ch, cancel
+}
@@ -0,0 +1,82 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"nullmail/internal/redis"
+)
+
+// Channel is the Redis pub/sub channel events are published on
+const Channel = "nullmail:events"
+
+// resubscribeDelay is the wait before retrying a failed subscription
+const resubscribeDelay = 5 * time.Second
+
+// RedisBroker publishes events through Redis pub/sub, so subscribers on
+// every replica receive them. A single subscription per process feeds
+// the local subscribers.
+type RedisBroker struct {
+	client *redis.Client
+	local  *MemoryBroker
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewRedisBroker subscribes to Channel until Close is called
+func NewRedisBroker(client *redis.Client) *RedisBroker {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &RedisBroker{
+		client: client,
+		local:  NewMemoryBroker(),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go b.receive(ctx)
+	return b
+}
+
+func (b *RedisBroker) Publish(event Event) error {
+	return b.client.Publish(Channel, event)
+}
+
+func (b *RedisBroker) Subscribe() (<-chan Event, func()) {
+	return b.local.Subscribe()
+}
+
+// Close stops the Redis subscription. It does not close the client.
+func (b *RedisBroker) Close() error {
+	b.cancel()
+	<-b.done
+	return nil
+}
+
+// receive forwards events from Redis to the local subscribers, subscribing
+// again if Redis is unavailable
+func (b *RedisBroker) receive(ctx context.Context) {
+	defer close(b.done)
+
+	for {
+		payloads, err := b.client.Subscribe(ctx, Channel)
+		if err != nil {
+			slog.Warn("Failed to subscribe to events, retrying", "channel", Channel, "error", err)
+		} else {
+			for payload := range payloads {
+				var event Event
+				if err := json.Unmarshal([]byte(payload), &event); err != nil {
+					slog.Warn("Ignoring malformed event", "channel", Channel, "error", err)
+					continue
+				}
+				b.local.Publish(event)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(resubscribeDelay):
+		}
+	}
+}
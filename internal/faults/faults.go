@@ -0,0 +1,250 @@
+// Package faults holds rules that make the SMTP server fail on purpose, so
+// that clients can test their retry and bounce handling.
+package faults
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stages a rule applies to
+const (
+	StageRcpt = "rcpt" // RCPT TO, per recipient
+	StageData = "data" // DATA or BDAT, once per message
+)
+
+// Codes lists the reply codes a rule can send
+var Codes = []int{421, 450, 452, 550, 552}
+
+// MaxDelay bounds the latency a rule can add
+const MaxDelay = 10 * time.Minute
+
+// ErrNotFound is returned when a rule does not exist
+var ErrNotFound = errors.New("fault rule not found")
+
+// Rule makes matching commands fail. A rule matches when both patterns
+// match; an empty pattern matches every address. Patterns are compared
+// case-insensitively and "*" matches any run of characters, so
+// "*@flaky.example.com" applies to a whole domain.
+//
+// A triggered rule first waits for Delay, then either drops the connection,
+// replies with Code, or, when neither is set, lets the command proceed.
+type Rule struct {
+	ID        string   `json:"id"`
+	Recipient string   `json:"recipient,omitempty"`
+	Sender    string   `json:"sender,omitempty"`
+	Stage     string   `json:"stage"`             // StageRcpt or StageData
+	Code      int      `json:"code,omitempty"`    // one of Codes
+	Message   string   `json:"message,omitempty"` // reply text, defaults to a generic one
+	Delay     Duration `json:"delay,omitempty"`
+	Drop      bool     `json:"drop,omitempty"`  // close the connection; mid-DATA at the data stage
+	Every     int      `json:"every,omitempty"` // trigger on every Nth matching attempt only
+
+	Attempts  int64 `json:"attempts"`  // matching attempts so far
+	Triggered int64 `json:"triggered"` // attempts the rule was applied to
+}
+
+// Duration is a time.Duration written as a string such as "2s" in JSON
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return errors.New("delay must be a duration string such as \"2s\"")
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid delay %q", value)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Validate checks a rule and fills in the default stage
+func (r *Rule) Validate() error {
+	r.Recipient = strings.ToLower(strings.TrimSpace(r.Recipient))
+	r.Sender = strings.ToLower(strings.TrimSpace(r.Sender))
+	r.Stage = strings.ToLower(r.Stage)
+
+	if r.Stage == "" {
+		r.Stage = StageRcpt
+	}
+	if r.Stage != StageRcpt && r.Stage != StageData {
+		return fmt.Errorf("stage must be %q or %q", StageRcpt, StageData)
+	}
+
+	for _, pattern := range []string{r.Recipient, r.Sender} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+
+	if r.Code != 0 && !validCode(r.Code) {
+		return fmt.Errorf("code must be one of %v", Codes)
+	}
+	if r.Code != 0 && r.Drop {
+		return errors.New("a rule either replies with a code or drops the connection")
+	}
+	if r.Delay < 0 || time.Duration(r.Delay) > MaxDelay {
+		return fmt.Errorf("delay must be between 0 and %s", MaxDelay)
+	}
+	if r.Code == 0 && !r.Drop && r.Delay == 0 {
+		return errors.New("a rule needs a code, a delay or drop")
+	}
+	if r.Every < 0 {
+		return errors.New("every must not be negative")
+	}
+	if strings.ContainsAny(r.Message, "\r\n") {
+		return errors.New("message must be a single line")
+	}
+	return nil
+}
+
+func validCode(code int) bool {
+	for _, valid := range Codes {
+		if code == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether the rule applies to a sender and any of the
+// recipients
+func (r *Rule) matches(stage, sender string, recipients []string) bool {
+	if r.Stage != stage || !match(r.Sender, sender) {
+		return false
+	}
+	for _, recipient := range recipients {
+		if match(r.Recipient, recipient) {
+			return true
+		}
+	}
+	return false
+}
+
+// AppliesTo reports whether the rule's recipient pattern matches address
+func (r *Rule) AppliesTo(address string) bool {
+	return match(r.Recipient, address)
+}
+
+func match(pattern, address string) bool {
+	if pattern == "" {
+		return true
+	}
+	// Patterns are validated when added
+	matched, _ := path.Match(pattern, strings.ToLower(address))
+	return matched
+}
+
+// Set is the list of active rules. It is safe for concurrent use by the SMTP
+// sessions and the API. Rules only apply within one process.
+type Set struct {
+	mu     sync.Mutex
+	rules  []*Rule
+	nextID int
+}
+
+func NewSet() *Set {
+	return &Set{}
+}
+
+// Add validates a rule, assigns it an ID and appends it to the set
+func (s *Set) Add(rule Rule) (Rule, error) {
+	if err := rule.Validate(); err != nil {
+		return Rule{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	rule.ID = strconv.Itoa(s.nextID)
+	rule.Attempts = 0
+	rule.Triggered = 0
+	s.rules = append(s.rules, &rule)
+	return rule, nil
+}
+
+// List returns copies of the rules in the order they are evaluated
+func (s *Set) List() []Rule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rules := make([]Rule, 0, len(s.rules))
+	for _, rule := range s.rules {
+		rules = append(rules, *rule)
+	}
+	return rules
+}
+
+// Get returns a copy of a rule
+func (s *Set) Get(id string) (Rule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rule := range s.rules {
+		if rule.ID == id {
+			return *rule, nil
+		}
+	}
+	return Rule{}, ErrNotFound
+}
+
+// Remove deletes a rule
+func (s *Set) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, rule := range s.rules {
+		if rule.ID == id {
+			s.rules = append(s.rules[:i], s.rules[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// Clear deletes every rule
+func (s *Set) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rules = nil
+}
+
+// Match evaluates the rules in order, counting an attempt against each one
+// that matches, and returns the first rule that triggers. A nil Set never
+// matches.
+func (s *Set) Match(stage, sender string, recipients ...string) (Rule, bool) {
+	if s == nil {
+		return Rule{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rule := range s.rules {
+		if !rule.matches(stage, sender, recipients) {
+			continue
+		}
+
+		rule.Attempts++
+		if rule.Every > 1 && rule.Attempts%int64(rule.Every) != 0 {
+			continue
+		}
+		rule.Triggered++
+		return *rule, true
+	}
+	return Rule{}, false
+}
@@ -0,0 +1,74 @@
+// Package ratelimit implements token-bucket rate limits, kept either in
+// process memory or in Redis so that replicas share them.
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit allows Events per Per on average. A bucket holds up to Events
+// tokens, so a client that has been quiet can send a burst of that size.
+type Limit struct {
+	Events int
+	Per    time.Duration
+}
+
+// Enabled reports whether the limit restricts anything
+func (l Limit) Enabled() bool {
+	return l.Events > 0 && l.Per > 0
+}
+
+// String formats the limit as accepted by ParseLimit
+func (l Limit) String() string {
+	if !l.Enabled() {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d/%s", l.Events, l.Per)
+}
+
+// ParseLimit reads a limit such as "100/h", "10/m" or "5/30s". An empty
+// string is the zero, disabled limit.
+func ParseLimit(value string) (Limit, error) {
+	if value == "" {
+		return Limit{}, nil
+	}
+
+	events, period, found := strings.Cut(value, "/")
+	if !found {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: expected events/period", value)
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(events))
+	if err != nil || n < 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: bad event count", value)
+	}
+
+	var per time.Duration
+	switch period = strings.TrimSpace(period); period {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	case "d":
+		per = 24 * time.Hour
+	default:
+		per, err = time.ParseDuration(period)
+		if err != nil || per <= 0 {
+			return Limit{}, fmt.Errorf("invalid rate limit %q: bad period", value)
+		}
+	}
+
+	return Limit{Events: n, Per: per}, nil
+}
+
+// Limiter takes tokens from named buckets
+type Limiter interface {
+	// Allow takes a token from the bucket for key and reports whether one
+	// was available. Disabled limits always allow.
+	Allow(key string, limit Limit) (bool, error)
+}
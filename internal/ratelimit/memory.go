@@ -0,0 +1,74 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepThreshold is the bucket count above which full buckets are dropped
+const sweepThreshold = 10000
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time // when the bucket will have refilled completely
+}
+
+// MemoryLimiter keeps buckets in process memory. Limits only apply within
+// one process.
+type MemoryLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+func (l *MemoryLimiter) Allow(key string, limit Limit) (bool, error) {
+	if !limit.Enabled() {
+		return true, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	capacity := float64(limit.Events)
+	rate := capacity / float64(limit.Per) // tokens per nanosecond
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= sweepThreshold {
+			l.sweep(now)
+		}
+		b = &bucket{tokens: capacity, updated: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += float64(now.Sub(b.updated)) * rate
+	if b.tokens > capacity {
+		b.tokens = capacity
+	}
+	b.updated = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	b.full = now.Add(time.Duration((capacity - b.tokens) / rate))
+	return allowed, nil
+}
+
+// sweep drops buckets that have refilled, as they behave like new ones
+func (l *MemoryLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if !now.Before(b.full) {
+			delete(l.buckets, key)
+		}
+	}
+}
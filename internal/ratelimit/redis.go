@@ -0,0 +1,21 @@
+package ratelimit
+
+import (
+	"nullmail/internal/redis"
+)
+
+// RedisLimiter keeps buckets in Redis so that limits hold across replicas
+type RedisLimiter struct {
+	client *redis.Client
+}
+
+func NewRedisLimiter(client *redis.Client) *RedisLimiter {
+	return &RedisLimiter{client: client}
+}
+
+func (l *RedisLimiter) Allow(key string, limit Limit) (bool, error) {
+	if !limit.Enabled() {
+		return true, nil
+	}
+	return l.client.TakeToken(key, limit.Events, limit.Per)
+}
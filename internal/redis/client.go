@@ -3,6 +3,7 @@ package redis
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
@@ -11,6 +12,9 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
+// ErrEmailNotFound is returned when an email key does not exist or has expired
+var ErrEmailNotFound = errors.New("email not found")
+
 type Client struct {
 	client *redis.Client
 	ctx    context.Context
@@ -121,13 +125,146 @@ func (c *Client) GetEmail(emailID string) (string, error) {
 	key := fmt.Sprintf("nullmail:email:%s", emailID)
 	result, err := c.client.Get(c.ctx, key).Result()
 	if err == redis.Nil {
-		return "", fmt.Errorf("email not found: %s", emailID)
+		return "", fmt.Errorf("%w: %s", ErrEmailNotFound, emailID)
 	} else if err != nil {
 		return "", fmt.Errorf("failed to get email from redis: %w", err)
 	}
 	return result, nil
 }
 
+// DeleteEmail removes an email and drops it from the global email list
+func (c *Client) DeleteEmail(emailID string) error {
+	key := fmt.Sprintf("nullmail:email:%s", emailID)
+	if err := c.client.Del(c.ctx, key).Err(); err != nil {
+		return fmt.Errorf("failed to delete email from redis: %w", err)
+	}
+
+	if err := c.client.LRem(c.ctx, "nullmail:emails", 0, emailID).Err(); err != nil {
+		return fmt.Errorf("failed to remove email from list: %w", err)
+	}
+
+	slog.Debug("Email deleted from Redis", "id", emailID, "key", key)
+	return nil
+}
+
+// RemoveEmailForRecipient drops an email ID from a recipient's index
+func (c *Client) RemoveEmailForRecipient(recipient, emailID string) error {
+	recipientKey := fmt.Sprintf("emails:%s", recipient)
+	if err := c.client.LRem(c.ctx, recipientKey, 0, emailID).Err(); err != nil {
+		return fmt.Errorf("failed to remove email from recipient %s: %w", recipient, err)
+	}
+	return nil
+}
+
+// StoreRaw stores the original bytes of an email
+func (c *Client) StoreRaw(emailID string, data []byte, ttl time.Duration) error {
+	key := fmt.Sprintf("nullmail:raw:%s", emailID)
+	if err := c.client.Set(c.ctx, key, data, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to store raw email in redis: %w", err)
+	}
+	return nil
+}
+
+// GetRaw returns the original bytes of an email
+func (c *Client) GetRaw(emailID string) ([]byte, error) {
+	key := fmt.Sprintf("nullmail:raw:%s", emailID)
+	data, err := c.client.Get(c.ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("%w: %s raw", ErrEmailNotFound, emailID)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get raw email from redis: %w", err)
+	}
+	return data, nil
+}
+
+// DeleteRaw removes the original bytes of an email
+func (c *Client) DeleteRaw(emailID string) error {
+	key := fmt.Sprintf("nullmail:raw:%s", emailID)
+	if err := c.client.Del(c.ctx, key).Err(); err != nil {
+		return fmt.Errorf("failed to delete raw email from redis: %w", err)
+	}
+	return nil
+}
+
+// ExpireRaw sets the TTL of the original bytes of an email
+func (c *Client) ExpireRaw(emailID string, ttl time.Duration) error {
+	key := fmt.Sprintf("nullmail:raw:%s", emailID)
+	if err := c.client.Expire(c.ctx, key, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to set TTL for raw email: %w", err)
+	}
+	return nil
+}
+
+// StoreAttachment stores the binary content of an email attachment
+func (c *Client) StoreAttachment(emailID string, index int, data []byte, ttl time.Duration) error {
+	key := fmt.Sprintf("nullmail:attachment:%s:%d", emailID, index)
+	if err := c.client.Set(c.ctx, key, data, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to store attachment in redis: %w", err)
+	}
+	return nil
+}
+
+// GetAttachment returns the binary content of an email attachment
+func (c *Client) GetAttachment(emailID string, index int) ([]byte, error) {
+	key := fmt.Sprintf("nullmail:attachment:%s:%d", emailID, index)
+	data, err := c.client.Get(c.ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("%w: %s attachment %d", ErrEmailNotFound, emailID, index)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get attachment from redis: %w", err)
+	}
+	return data, nil
+}
+
+// DeleteAttachments removes the binary content of an email's attachments
+func (c *Client) DeleteAttachments(emailID string, count int) error {
+	if count == 0 {
+		return nil
+	}
+
+	keys := make([]string, count)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("nullmail:attachment:%s:%d", emailID, i)
+	}
+	if err := c.client.Del(c.ctx, keys...).Err(); err != nil {
+		return fmt.Errorf("failed to delete attachments from redis: %w", err)
+	}
+	return nil
+}
+
+// ExpireAttachments sets the TTL of an email's attachment content
+func (c *Client) ExpireAttachments(emailID string, count int, ttl time.Duration) error {
+	for i := 0; i < count; i++ {
+		key := fmt.Sprintf("nullmail:attachment:%s:%d", emailID, i)
+		if err := c.client.Expire(c.ctx, key, ttl).Err(); err != nil {
+			return fmt.Errorf("failed to set TTL for attachment: %w", err)
+		}
+	}
+	return nil
+}
+
+// DeleteRecipientIndex removes a recipient's whole email index
+func (c *Client) DeleteRecipientIndex(recipient string) error {
+	recipientKey := fmt.Sprintf("emails:%s", recipient)
+	if err := c.client.Del(c.ctx, recipientKey).Err(); err != nil {
+		return fmt.Errorf("failed to delete recipient index %s: %w", recipient, err)
+	}
+	return nil
+}
+
+// ExpireEmail sets the TTL of a stored email
+func (c *Client) ExpireEmail(emailID string, ttl time.Duration) error {
+	key := fmt.Sprintf("nullmail:email:%s", emailID)
+	ok, err := c.client.Expire(c.ctx, key, ttl).Result()
+	if err != nil {
+		return fmt.Errorf("failed to set TTL for email: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrEmailNotFound, emailID)
+	}
+	return nil
+}
+
 func (c *Client) GetAllEmails() ([]string, error) {
 	result, err := c.client.LRange(c.ctx, "nullmail:emails", 0, -1).Result()
 	if err != nil {
@@ -192,3 +329,119 @@ func (c *Client) GetEmailCount(countType string) (int64, error) {
 	}
 	return count, nil
 }
+
+// StoreTranscript stores the JSON transcript of an SMTP session
+func (c *Client) StoreTranscript(sessionID string, transcript interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(transcript)
+	if err != nil {
+		return fmt.Errorf("failed to marshal transcript: %w", err)
+	}
+
+	key := fmt.Sprintf("nullmail:transcript:%s", sessionID)
+	if err := c.client.Set(c.ctx, key, data, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to store transcript in redis: %w", err)
+	}
+	return nil
+}
+
+// GetTranscript returns the JSON transcript of an SMTP session
+func (c *Client) GetTranscript(sessionID string) ([]byte, error) {
+	key := fmt.Sprintf("nullmail:transcript:%s", sessionID)
+	data, err := c.client.Get(c.ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("%w: transcript %s", ErrEmailNotFound, sessionID)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get transcript from redis: %w", err)
+	}
+	return data, nil
+}
+
+// Publish sends a JSON message on a pub/sub channel
+func (c *Client) Publish(channel string, message interface{}) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	if err := c.client.Publish(c.ctx, channel, data).Err(); err != nil {
+		return fmt.Errorf("failed to publish to redis: %w", err)
+	}
+	return nil
+}
+
+// Subscribe delivers the payloads published on channel until ctx is done,
+// when the returned channel is closed. Connection failures after the
+// subscription succeeded are retried by the driver.
+func (c *Client) Subscribe(ctx context.Context, channel string) (<-chan string, error) {
+	pubsub := c.client.Subscribe(ctx, channel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, fmt.Errorf("failed to subscribe to redis channel %s: %w", channel, err)
+	}
+
+	payloads := make(chan string)
+	go func() {
+		defer close(payloads)
+		defer pubsub.Close()
+
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				select {
+				case payloads <- msg.Payload:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return payloads, nil
+}
+
+// takeTokenScript refills a token bucket stored as a hash and takes one
+// token from it. Running it as a script keeps concurrent replicas from
+// double-spending tokens.
+var takeTokenScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+	tokens = capacity
+	ts = now
+end
+
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * capacity / period)
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], period)
+return allowed
+`)
+
+// TakeToken takes a token from the rate limit bucket for key, which holds up
+// to capacity tokens and refills completely over period. It reports whether
+// a token was available.
+func (c *Client) TakeToken(key string, capacity int, period time.Duration) (bool, error) {
+	redisKey := fmt.Sprintf("nullmail:ratelimit:%s", key)
+	allowed, err := takeTokenScript.Run(c.ctx, c.client, []string{redisKey},
+		capacity, period.Milliseconds(), time.Now().UnixMilli()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to take rate limit token: %w", err)
+	}
+	return allowed == 1, nil
+}
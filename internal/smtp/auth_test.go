@@ -0,0 +1,73 @@
+package smtp
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestAuthRejectsControlCharactersInUsername(t *testing.T) {
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	type step struct {
+		line string
+		code int
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "PLAIN",
+			steps: []step{
+				{"AUTH PLAIN " + b64("\x00user\x00secret"), 235},
+			},
+		},
+		{
+			name: "PLAIN with CRLF",
+			steps: []step{
+				{"AUTH PLAIN " + b64("\x00evil\r\nSubject: spoofed\x00secret"), 501},
+			},
+		},
+		{
+			name: "LOGIN with LF",
+			steps: []step{
+				{"AUTH LOGIN " + b64("evil\nuser"), 334},
+				{b64("secret"), 501},
+			},
+		},
+		{
+			name: "LOGIN with NUL",
+			steps: []step{
+				{"AUTH LOGIN", 334},
+				{b64("evil\x00user"), 334},
+				{b64("secret"), 501},
+			},
+		},
+		{
+			name: "CRAM-MD5 with CR",
+			steps: []step{
+				{"AUTH CRAM-MD5", 334},
+				{b64("evil\ruser 0123456789abcdef0123456789abcdef"), 501},
+			},
+		},
+		{
+			name: "rejected username leaves the session unauthenticated",
+			steps: []step{
+				{"AUTH PLAIN " + b64("\x00evil\nuser\x00secret"), 501},
+				{"AUTH PLAIN " + b64("\x00user\x00secret"), 235},
+			},
+		},
+	}
+
+	addr, _ := startTestServer(t, Config{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dialTestServer(t, addr)
+			client.cmd("EHLO client.example.com", 250)
+			for _, step := range tt.steps {
+				client.cmd(step.line, step.code)
+			}
+		})
+	}
+}
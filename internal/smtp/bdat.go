@@ -0,0 +1,119 @@
+package smtp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"nullmail/internal/faults"
+)
+
+// handleBdat implements RFC 3030 CHUNKING. Each BDAT command is followed by
+// exactly the announced number of octets, with no dot-stuffing. The chunk is
+// always consumed, even when it is rejected, so the command stream stays in
+// sync. Like handleSMTPCommand it returns 0 when the connection must be
+// closed.
+func (s *SMTPServer) handleBdat(cmd string, reader *bufio.Reader, writer *bufio.Writer, clientAddr string, session *SMTPSession) int {
+	parts := strings.Fields(cmd)
+	if len(parts) < 2 || len(parts) > 3 {
+		s.sendResponse(writer, CodeSyntaxError, StatusInvalidParameters, MsgSyntaxError)
+		return 1
+	}
+
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		s.sendResponse(writer, CodeSyntaxError, StatusInvalidParameters, MsgSyntaxError)
+		return 1
+	}
+
+	last := len(parts) == 3 && strings.EqualFold(parts[2], "LAST")
+	if len(parts) == 3 && !last {
+		s.sendResponse(writer, CodeSyntaxError, StatusInvalidParameters, MsgSyntaxError)
+		return 1
+	}
+
+	chunk := &idleReader{reader: reader, conn: session.conn, timeout: s.config.Limits.DataTimeout}
+	readFailed := func(err error) int {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			slog.Info("Client timed out sending BDAT chunk", "client", clientAddr, "timeout", s.config.Limits.DataTimeout)
+			session.conn.SetWriteDeadline(time.Now().Add(replyTimeout))
+			s.sendResponse(writer, CodeServiceNotAvailable, StatusTimeout, s.domains.hostname+" "+MsgTimeout)
+		} else {
+			slog.Error("Error reading BDAT chunk", "error", err, "client", clientAddr)
+		}
+		return 0
+	}
+
+	reject := func(code, status, message string) int {
+		if _, err := io.CopyN(io.Discard, chunk, size); err != nil {
+			return readFailed(err)
+		}
+		session.transcript.client(fmt.Sprintf("[%d octets of message content discarded]", size))
+		s.sendResponse(writer, code, status, message)
+		return 1
+	}
+
+	switch {
+	case session.from == "":
+		return reject(CodeBadSequence, StatusInvalidCommand, MsgNeedMail)
+	case len(session.recipients) == 0:
+		return reject(CodeBadSequence, StatusInvalidCommand, MsgNeedRcpt)
+	case s.store == nil:
+		slog.Warn("Rejecting BDAT, no storage available", "client", clientAddr)
+		session.resetTransaction()
+		return reject(CodeRequestedActionAborted, StatusLocalError, MsgStorageUnavailable)
+	case int64(session.chunks.Len())+size > MaxMessageSize:
+		slog.Error("Message too large", "size", int64(session.chunks.Len())+size, "limit", MaxMessageSize)
+		session.resetTransaction()
+		return reject(CodeMessageTooLarge, StatusMessageTooLarge, MsgMessageTooLarge)
+	case !session.chunking && !s.allowMessage(clientAddr, session):
+		session.resetTransaction()
+		return reject(CodeMailboxUnavailable, StatusRateLimit, MsgSenderRateExceeded)
+	}
+
+	session.chunking = true
+	if _, err := io.CopyN(&session.chunks, chunk, size); err != nil {
+		session.resetTransaction()
+		return readFailed(err)
+	}
+	session.transcript.content(session.chunks.Bytes()[int64(session.chunks.Len())-size:])
+
+	if !last {
+		s.sendResponse(writer, CodeOK, StatusOK, fmt.Sprintf(MsgChunkReceived, size))
+		return 1
+	}
+
+	// Whatever the outcome, the envelope belongs to this message only
+	defer session.resetTransaction()
+
+	if rule, faulted := s.matchFault(faults.StageData, clientAddr, session, session.recipients...); faulted {
+		if result, replied := s.applyFault(writer, rule); replied {
+			return result
+		}
+	}
+
+	raw := make([]byte, session.chunks.Len())
+	copy(raw, session.chunks.Bytes())
+	s.deliverMessage(writer, clientAddr, session, raw)
+	return 1
+}
+
+// idleReader extends the connection deadline before every read, so that the
+// timeout bounds the time between reads rather than the whole chunk
+type idleReader struct {
+	reader  io.Reader
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	r.conn.SetDeadline(time.Now().Add(r.timeout))
+	return r.reader.Read(p)
+}
@@ -0,0 +1,146 @@
+package smtp
+
+import (
+	"fmt"
+	"testing"
+)
+
+// bdat returns a BDAT command followed by its chunk
+func bdat(chunk string, last bool) string {
+	command := fmt.Sprintf("BDAT %d", len(chunk))
+	if last {
+		command += " LAST"
+	}
+	return command + "\r\n" + chunk
+}
+
+func TestBdat(t *testing.T) {
+	type step struct {
+		send string // sent as is, including any line ending
+		code int
+	}
+
+	const envelope = "MAIL FROM:<a@example.com>\r\n"
+
+	tests := []struct {
+		name  string
+		steps []step
+		raw   string // message stored for b@example.com, empty if none
+	}{
+		{
+			name: "single chunk",
+			steps: []step{
+				{envelope, 250},
+				{"RCPT TO:<b@example.com>\r\n", 250},
+				{bdat("Subject: one\r\n\r\nbody\r\n", true), 250},
+			},
+			raw: "Subject: one\r\n\r\nbody\r\n",
+		},
+		{
+			name: "chunks are joined without dot-unstuffing",
+			steps: []step{
+				{envelope, 250},
+				{"RCPT TO:<b@example.com>\r\n", 250},
+				{bdat("Subject: two\r\n\r\n..dots\r\n", false), 250},
+				{bdat(".\r\nnot the end\r\n", false), 250},
+				{bdat("", true), 250},
+			},
+			raw: "Subject: two\r\n\r\n..dots\r\n.\r\nnot the end\r\n",
+		},
+		{
+			name: "binary content",
+			steps: []step{
+				{"MAIL FROM:<a@example.com> BODY=BINARYMIME\r\n", 250},
+				{"RCPT TO:<b@example.com>\r\n", 250},
+				{bdat("Subject: bin\r\n\r\n\x00\xff\r\x01", true), 250},
+			},
+			raw: "Subject: bin\r\n\r\n\x00\xff\r\x01",
+		},
+		{
+			name: "BDAT before MAIL consumes the chunk",
+			steps: []step{
+				{bdat("RSET\r\n", true), 503},
+				{"NOOP\r\n", 250},
+			},
+		},
+		{
+			name: "BDAT before RCPT",
+			steps: []step{
+				{envelope, 250},
+				{bdat("data", true), 503},
+			},
+		},
+		{
+			name: "DATA during a BDAT transfer",
+			steps: []step{
+				{envelope, 250},
+				{"RCPT TO:<b@example.com>\r\n", 250},
+				{bdat("part", false), 250},
+				{"DATA\r\n", 503},
+			},
+		},
+		{
+			name: "RSET discards received chunks",
+			steps: []step{
+				{envelope, 250},
+				{"RCPT TO:<b@example.com>\r\n", 250},
+				{bdat("discarded", false), 250},
+				{"RSET\r\n", 250},
+				{envelope, 250},
+				{"RCPT TO:<b@example.com>\r\n", 250},
+				{bdat("Subject: kept\r\n\r\n", true), 250},
+			},
+			raw: "Subject: kept\r\n\r\n",
+		},
+		{
+			name: "invalid size",
+			steps: []step{
+				{"BDAT -1\r\n", 501},
+				{"BDAT ten\r\n", 501},
+			},
+		},
+		{
+			name: "unknown final argument",
+			steps: []step{
+				{envelope, 250},
+				{"RCPT TO:<b@example.com>\r\n", 250},
+				{"BDAT 0 FIRST\r\n", 501},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, store := startTestServer(t, Config{})
+			client := dialTestServer(t, addr)
+			client.cmd("EHLO client.example.com", 250)
+
+			for _, step := range tt.steps {
+				client.write(step.send)
+				client.expect(step.code)
+			}
+
+			ids, err := store.ListByRecipient("b@example.com")
+			if err != nil {
+				t.Fatalf("ListByRecipient: %v", err)
+			}
+			if tt.raw == "" {
+				if len(ids) != 0 {
+					t.Fatalf("stored %d messages, want none", len(ids))
+				}
+				return
+			}
+			if len(ids) != 1 {
+				t.Fatalf("stored %d messages, want 1", len(ids))
+			}
+
+			raw, err := store.GetRaw(ids[0])
+			if err != nil {
+				t.Fatalf("GetRaw: %v", err)
+			}
+			if string(raw) != tt.raw {
+				t.Errorf("raw message = %q, want %q", raw, tt.raw)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package smtp
+
+import (
+	"time"
+
+	"nullmail/internal/events"
+	"nullmail/internal/faults"
+	"nullmail/internal/ratelimit"
+)
+
+// Config holds the behaviour of an SMTPServer that can be changed per instance
+type Config struct {
+	Auth      AuthConfig
+	TLS       TLSConfig
+	Limits    LimitsConfig
+	RateLimit RateLimitConfig
+	Domains   DomainConfig
+
+	// Faults makes matching RCPT and DATA commands fail on purpose. Rules
+	// can be changed while the server runs. Nil disables fault injection.
+	Faults *faults.Set
+
+	// Events is notified of every stored message. Nil disables events.
+	Events events.Broker
+}
+
+// DomainConfig lists the domains the server accepts mail for
+type DomainConfig struct {
+	// Local lists the recipient domains. "*.example.com" matches every
+	// subdomain of example.com, but not example.com itself. RCPT to any
+	// other domain is rejected with 550. When empty, every domain is
+	// accepted (catch-all).
+	Local []string
+
+	// Hostname is announced in the greeting and the HELO/EHLO reply. It
+	// defaults to the first exact entry of Local, or DefaultHostname.
+	Hostname string
+}
+
+// AuthConfig controls SMTP AUTH
+type AuthConfig struct {
+	// Users maps usernames to passwords
+	Users map[string]string
+
+	// AcceptAny accepts any username and password. It is implied when no
+	// users are configured.
+	AcceptAny bool
+}
+
+// TLSConfig controls certificates and whether encryption is mandatory
+type TLSConfig struct {
+	// CertFile and KeyFile are PEM files of the server certificate. They are
+	// reloaded when either file changes. The server does not serve if they
+	// cannot be loaded.
+	CertFile string
+	KeyFile  string
+
+	// DevCADir holds a self-signed development CA, created on first use,
+	// that issues the certificate when no CertFile is configured. Without it
+	// a throwaway CA is generated on every start.
+	DevCADir string
+
+	// Require rejects MAIL and AUTH with 530 until the session is encrypted
+	Require bool
+}
+
+// Defaults for LimitsConfig. The timeouts are the minimums of RFC 5321
+// 4.5.3.2.
+const (
+	DefaultCommandTimeout   = 5 * time.Minute
+	DefaultDataTimeout      = 3 * time.Minute
+	DefaultMaxSessions      = 1000
+	DefaultMaxSessionsPerIP = 100
+)
+
+// MaxCommandLineLength is the longest command line accepted, including CRLF
+const MaxCommandLineLength = 1000
+
+// MaxAuthLineLength is the longest AUTH response line accepted, including
+// CRLF (RFC 4954 section 4)
+const MaxAuthLineLength = 12288
+
+// LimitsConfig bounds the resources a client can hold. Zero values select
+// the defaults.
+type LimitsConfig struct {
+	// CommandTimeout is how long the server waits for the next command
+	CommandTimeout time.Duration
+
+	// DataTimeout is how long the server waits for more message content
+	// during DATA or BDAT
+	DataTimeout time.Duration
+
+	// MaxSessions caps concurrent sessions across all clients, and
+	// MaxSessionsPerIP caps them per client address. Connections over the
+	// cap are answered with 421 and closed. Negative values disable a cap.
+	MaxSessions      int
+	MaxSessionsPerIP int
+}
+
+func (l LimitsConfig) withDefaults() LimitsConfig {
+	if l.CommandTimeout <= 0 {
+		l.CommandTimeout = DefaultCommandTimeout
+	}
+	if l.DataTimeout <= 0 {
+		l.DataTimeout = DefaultDataTimeout
+	}
+	if l.MaxSessions == 0 {
+		l.MaxSessions = DefaultMaxSessions
+	}
+	if l.MaxSessionsPerIP == 0 {
+		l.MaxSessionsPerIP = DefaultMaxSessionsPerIP
+	}
+	return l
+}
+
+// RateLimitConfig throttles clients with token buckets. A zero Limit is
+// disabled. Rejections are temporary, so well-behaved senders retry later.
+type RateLimitConfig struct {
+	// ConnectionsPerIP limits new sessions per client IP. Sessions over the
+	// limit may still greet, but MAIL is answered with 450.
+	ConnectionsPerIP ratelimit.Limit
+
+	// MessagesPerSender limits messages per MAIL FROM address, checked at
+	// DATA or the first BDAT chunk with 450
+	MessagesPerSender ratelimit.Limit
+
+	// MessagesPerRecipient limits messages per recipient, checked at RCPT
+	// with 452
+	MessagesPerRecipient ratelimit.Limit
+
+	// Limiter holds the buckets. Defaults to an in-process limiter; use a
+	// Redis limiter to share limits across replicas.
+	Limiter ratelimit.Limiter
+}
@@ -1,5 +1,7 @@
 package smtp
 
+import "fmt"
+
 const (
 	// Success codes
 	CodeOK             = "250"
@@ -11,46 +13,130 @@ const (
 	CodeStartTLS       = "220"
 
 	// Error codes
-	CodeSyntaxError            = "501"
-	CodeCommandNotRecognized   = "500"
-	CodeCommandNotImplemented  = "502"
-	CodeRequestedActionAborted = "451"
-	CodeAuthenticationFailed   = "535"
-	CodeUserNotLocal           = "550"
-	CodeCannotVerify           = "252"
-	CodeMessageTooLarge        = "552"
-	CodeTLSRequired            = "530"
+	CodeSyntaxError              = "501"
+	CodeCommandNotRecognized     = "500"
+	CodeCommandNotImplemented    = "502"
+	CodeBadSequence              = "503"
+	CodeParameterNotImplemented  = "504"
+	CodeAuthMechanismUnsupported = "504"
+	CodeServiceNotAvailable      = "421"
+	CodeMailboxUnavailable       = "450"
+	CodeInsufficientStorage      = "452"
+	CodeRequestedActionAborted   = "451"
+	CodeAuthenticationFailed     = "535"
+	CodeUserNotLocal             = "550"
+	CodeCannotVerify             = "252"
+	CodeMessageTooLarge          = "552"
+	CodeTLSRequired              = "530"
 )
 
+// Enhanced status codes (RFC 3463), sent after the reply code once
+// ENHANCEDSTATUSCODES is advertised (RFC 2034)
 const (
-	MsgServiceReady           = "temp-smtp.local ESMTP Ready"
-	MsgServiceClosing         = "Bye"
-	MsgOK                     = "OK"
-	MsgMessageAccepted        = "OK: Message accepted for delivery"
-	MsgStartMailInput         = "Start mail input; end with <CRLF>.<CRLF>"
-	MsgSyntaxError            = "Syntax error"
-	MsgCommandNotRecognized   = "Command not recognized"
-	MsgCommandNotImplemented  = "Command not implemented"
-	MsgRequestedActionAborted = "Requested action aborted: local error in processing"
-	MsgAuthSuccessful         = "Authentication successful"
-	MsgAuthFailed             = "Authentication failed"
-	MsgAuthContinue           = ""
-	MsgUserNotLocal           = "User not local"
-	MsgCannotVerify           = "Cannot verify user, but will accept message"
-	MsgHelpMessage            = "Commands: HELO EHLO MAIL RCPT DATA VRFY EXPN HELP RSET NOOP QUIT AUTH STARTTLS"
-	MsgTurnNotSupported       = "Turn not supported"
-	MsgStartTLS               = "Ready to start TLS"
-	MsgMessageTooLarge        = "Message too large"
-	MsgTLSRequired            = "Must issue STARTTLS first"
-	MsgInvalidUTF             = "Invalid UTF-8"
+	StatusOK                  = "2.0.0"
+	StatusSenderOK            = "2.1.0"
+	StatusRecipientOK         = "2.1.5"
+	StatusAuthSuccessful      = "2.7.0"
+	StatusLocalError          = "4.3.0"
+	StatusMailboxBusy         = "4.2.0"
+	StatusRecipientRateLimit  = "4.2.1"
+	StatusMailboxFull         = "4.2.2"
+	StatusNotAccepting        = "4.3.2"
+	StatusTimeout             = "4.4.2"
+	StatusPolicy              = "4.7.0"
+	StatusRateLimit           = "4.7.1"
+	StatusUndefined           = "5.0.0"
+	StatusBadMailbox          = "5.1.1"
+	StatusBadRecipientSyntax  = "5.1.3"
+	StatusBadSenderSyntax     = "5.1.7"
+	StatusMailboxFullPerm     = "5.2.2"
+	StatusNotCapable          = "5.3.3"
+	StatusMessageTooLarge     = "5.3.4"
+	StatusInvalidCommand      = "5.5.1"
+	StatusCommandUnrecognized = "5.5.2"
+	StatusAuthLineTooLong     = "5.5.6"
+	StatusInvalidParameters   = "5.5.4"
+	StatusTLSRequired         = "5.7.0"
+	StatusAuthFailed          = "5.7.8"
 )
 
 const (
-	EHLOGreetingTemplate = "250-temp-smtp.local\r\n250-8BITMIME\r\n250-AUTH PLAIN LOGIN\r\n250-STARTTLS\r\n250-SIZE %d\r\n250-SMTPUTF8\r\n250 HELP\r\n"
+	MsgServiceReady             = "ESMTP Ready"
+	MsgServiceClosing           = "Bye"
+	MsgOK                       = "OK"
+	MsgMessageAccepted          = "OK: Message accepted for delivery"
+	MsgStartMailInput           = "Start mail input; end with <CRLF>.<CRLF>"
+	MsgSyntaxError              = "Syntax error"
+	MsgCommandNotRecognized     = "Command not recognized"
+	MsgCommandNotImplemented    = "Command not implemented"
+	MsgRequestedActionAborted   = "Requested action aborted: local error in processing"
+	MsgAuthSuccessful           = "Authentication successful"
+	MsgAuthFailed               = "Authentication failed"
+	MsgAuthContinue             = ""
+	MsgAuthCancelled            = "Authentication cancelled"
+	MsgAuthMalformed            = "Cannot decode authentication response"
+	MsgAuthMechanismUnsupported = "Unrecognized authentication type"
+	MsgAlreadyAuthenticated     = "Already authenticated"
+	MsgHeloFirst                = "Bad sequence of commands: send HELO/EHLO first"
+	MsgSenderAlreadySpecified   = "Bad sequence of commands: sender already specified"
+	MsgNeedMail                 = "Bad sequence of commands: need MAIL command"
+	MsgNeedRcpt                 = "Bad sequence of commands: need RCPT command"
+	MsgBinaryMIMERequiresBdat   = "Bad sequence of commands: BODY=BINARYMIME requires BDAT"
+	MsgBdatInProgress           = "Bad sequence of commands: BDAT transfer in progress"
+	MsgBodyTypeUnsupported      = "BODY parameter value not supported"
+	MsgChunkReceived            = "%d octets received"
+	MsgAuthDuringTransaction    = "AUTH not permitted during a mail transaction"
+	MsgUserNotLocal             = "User not local"
+	MsgCannotVerify             = "Cannot verify user, but will accept message"
+	MsgHelpMessage              = "Commands: HELO EHLO MAIL RCPT DATA VRFY EXPN HELP RSET NOOP QUIT AUTH STARTTLS BDAT"
+	MsgTurnNotSupported         = "Turn not supported"
+	MsgStartTLS                 = "Ready to start TLS"
+	MsgMessageTooLarge          = "Message too large"
+	MsgTLSRequired              = "Must issue STARTTLS first"
+	MsgInvalidUTF               = "Invalid UTF-8"
+	MsgServiceShuttingDown      = "Service shutting down, closing transmission channel"
+	MsgStorageUnavailable       = "Requested action aborted: message storage unavailable"
+	MsgLineTooLong              = "Line too long"
+	MsgAuthLineTooLong          = "Authentication exchange line is too long"
+	MsgTimeout                  = "Timeout exceeded, closing transmission channel"
+	MsgTooManySessions          = "Too many concurrent sessions, try again later"
+	MsgTooManySessionsFromIP    = "Too many concurrent sessions from your address, try again later"
+	MsgConnectionRateExceeded   = "Too many connections from your address, try again later"
+	MsgSenderRateExceeded       = "Sender is sending mail too fast, try again later"
+	MsgRecipientRateExceeded    = "Recipient is receiving mail too fast, try again later"
+	MsgDomainNotLocal           = "Recipient domain is not served here"
+	MsgServiceUnavailable       = "Service not available, closing transmission channel"
+	MsgMailboxBusy              = "Mailbox unavailable, try again later"
+	MsgMailboxFull              = "Mailbox full, try again later"
+	MsgMailboxUnavailable       = "Mailbox unavailable"
+	MsgMailboxFullPerm          = "Mailbox full"
 )
 
+// ehloLines returns the EHLO reply: the hostname followed by the supported
+// extensions. STARTTLS is only offered when TLS is available and the session
+// is not encrypted yet (RFC 3207 section 4.2).
+func ehloLines(hostname string, offerStartTLS bool) []string {
+	lines := []string{
+		hostname,
+		"8BITMIME",
+		"PIPELINING",
+		"CHUNKING",
+		"BINARYMIME",
+		"ENHANCEDSTATUSCODES",
+		"AUTH PLAIN LOGIN CRAM-MD5",
+	}
+	if offerStartTLS {
+		lines = append(lines, "STARTTLS")
+	}
+	return append(lines,
+		fmt.Sprintf("SIZE %d", MaxMessageSize),
+		"SMTPUTF8",
+		"HELP",
+	)
+}
+
 const (
-	DefaultHostname = "temp-smtp.local"
+	DefaultHostname = "temp-smtp.local" // used when no local domain is configured
 	DefaultPort     = ":2525"
 	MaxMessageSize  = 25000000 // 25MB
 )
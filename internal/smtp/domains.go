@@ -0,0 +1,97 @@
+package smtp
+
+import (
+	"sort"
+	"strings"
+)
+
+// domainPolicy decides which recipient domains are local, i.e. which
+// domains the server accepts mail for
+type domainPolicy struct {
+	exact    map[string]bool
+	suffixes []string // ".example.com" for a "*.example.com" entry
+	hostname string
+}
+
+func newDomainPolicy(config DomainConfig) *domainPolicy {
+	policy := &domainPolicy{exact: make(map[string]bool)}
+
+	for _, domain := range config.Local {
+		domain = normalizeDomain(domain)
+		if domain == "" {
+			continue
+		}
+		if suffix, ok := strings.CutPrefix(domain, "*."); ok {
+			policy.suffixes = append(policy.suffixes, "."+suffix)
+			continue
+		}
+		policy.exact[domain] = true
+		if policy.hostname == "" {
+			policy.hostname = domain
+		}
+	}
+
+	if config.Hostname != "" {
+		policy.hostname = config.Hostname
+	}
+	if policy.hostname == "" {
+		policy.hostname = DefaultHostname
+	}
+	return policy
+}
+
+// catchAll reports whether mail is accepted for every domain
+func (p *domainPolicy) catchAll() bool {
+	return len(p.exact) == 0 && len(p.suffixes) == 0
+}
+
+// isLocal reports whether mail for address is accepted
+func (p *domainPolicy) isLocal(address string) bool {
+	if p.catchAll() {
+		return true
+	}
+
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return false
+	}
+	domain := normalizeDomain(address[at+1:])
+
+	if p.exact[domain] {
+		return true
+	}
+	for _, suffix := range p.suffixes {
+		if strings.HasSuffix(domain, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// certHosts returns the names the development certificate must be valid
+// for: the hostname, the local domains, including wildcards, and localhost
+func (p *domainPolicy) certHosts() []string {
+	hosts := []string{p.hostname}
+	seen := map[string]bool{p.hostname: true, "localhost": true}
+
+	var domains []string
+	for domain := range p.exact {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for _, suffix := range p.suffixes {
+		domains = append(domains, "*"+suffix)
+	}
+
+	for _, domain := range domains {
+		if !seen[domain] {
+			seen[domain] = true
+			hosts = append(hosts, domain)
+		}
+	}
+	return append(hosts, "localhost")
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
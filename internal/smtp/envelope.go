@@ -0,0 +1,115 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"nullmail/internal/storage"
+)
+
+// newSessionID returns a random identifier for a session, recorded on every
+// message it delivers and in the Received header
+func newSessionID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// protocol returns the RFC 3848 name of the session's protocol, as used in
+// the "with" clause of Received headers
+func (session *SMTPSession) protocol() string {
+	if !session.extended {
+		return "SMTP"
+	}
+
+	protocol := "ESMTP"
+	if session.isTLS {
+		protocol += "S"
+	}
+	if session.authUser != "" {
+		protocol += "A"
+	}
+	return protocol
+}
+
+// envelope captures the session and transaction state of the message
+// being delivered
+func (session *SMTPSession) envelope() *storage.Envelope {
+	envelope := &storage.Envelope{
+		SessionID: session.id,
+		ClientIP:  session.clientIP,
+		HeloName:  session.heloName,
+		Protocol:  session.protocol(),
+		Listener:  session.listener,
+		AuthUser:  session.authUser,
+		MailFrom:  session.from,
+		RcptTo:    append([]string(nil), session.recipients...),
+		Size:      session.messageSize,
+		Body:      session.bodyType,
+		SMTPUTF8:  session.isUTF8,
+	}
+	if session.isTLS {
+		envelope.TLS = &storage.TLSInfo{
+			Version:     session.tlsVersion,
+			CipherSuite: session.tlsCipher,
+		}
+	}
+	return envelope
+}
+
+// traceHeaders returns the Return-Path and Received header fields that a
+// delivering MTA prepends to a message (RFC 5321 4.4). Values supplied by the
+// client are sanitised so they cannot end the field or add new ones.
+func traceHeaders(envelope *storage.Envelope, hostname string, now time.Time) []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "Return-Path: <%s>\r\n", traceValue(envelope.MailFrom))
+
+	fmt.Fprintf(&buf, "Received: from %s (%s)\r\n", traceValue(envelope.HeloName), addressLiteral(envelope.ClientIP))
+	if envelope.TLS != nil {
+		fmt.Fprintf(&buf, "\t(using %s with cipher %s)\r\n", envelope.TLS.Version, envelope.TLS.CipherSuite)
+	}
+	if envelope.AuthUser != "" {
+		fmt.Fprintf(&buf, "\t(Authenticated sender: %s)\r\n", traceComment(envelope.AuthUser))
+	}
+	fmt.Fprintf(&buf, "\tby %s (nullmail) with %s id %s", hostname, envelope.Protocol, envelope.SessionID)
+
+	// Like most MTAs, only name the recipient when there is a single one
+	if len(envelope.RcptTo) == 1 {
+		fmt.Fprintf(&buf, "\r\n\tfor <%s>", traceValue(envelope.RcptTo[0]))
+	}
+	fmt.Fprintf(&buf, ";\r\n\t%s\r\n", now.Format(time.RFC1123Z))
+
+	return buf.Bytes()
+}
+
+// traceValue drops control characters, CR and LF among them, from a value
+// written into a trace header field
+func traceValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, value)
+}
+
+// traceComment is traceValue for text inside a comment, with the comment
+// delimiters escaped as quoted-pairs (RFC 5322 3.2.2)
+func traceComment(value string) string {
+	return commentEscaper.Replace(traceValue(value))
+}
+
+var commentEscaper = strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`)
+
+// addressLiteral formats an IP address as an RFC 5321 address literal
+func addressLiteral(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "[IPv6:" + ip + "]"
+	}
+	return "[" + ip + "]"
+}
@@ -0,0 +1,80 @@
+package smtp
+
+import (
+	"bytes"
+	"net/mail"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"nullmail/internal/storage"
+)
+
+func TestTraceHeadersSanitiseClientValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		envelope storage.Envelope
+	}{
+		{
+			name:     "AUTH user",
+			envelope: storage.Envelope{AuthUser: "evil\r\nSubject: spoofed"},
+		},
+		{
+			name:     "AUTH user closing the comment",
+			envelope: storage.Envelope{AuthUser: "evil) by other.example.com (\\"},
+		},
+		{
+			name:     "HELO name",
+			envelope: storage.Envelope{HeloName: "client\rSubject: spoofed"},
+		},
+		{
+			name:     "MAIL FROM",
+			envelope: storage.Envelope{MailFrom: "a@example.com>\r\n\r\nbody"},
+		},
+		{
+			name:     "RCPT TO",
+			envelope: storage.Envelope{RcptTo: []string{"b@example.com>\nSubject: spoofed"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.envelope.ClientIP = "192.0.2.1"
+			tt.envelope.Protocol = "ESMTP"
+			tt.envelope.SessionID = "0123456789abcdef"
+
+			trace := traceHeaders(&tt.envelope, "mx.example.com", time.Now())
+			msg, err := mail.ReadMessage(bytes.NewReader(append(trace, "Subject: real\r\n\r\nbody\r\n"...)))
+			if err != nil {
+				t.Fatalf("ReadMessage: %v", err)
+			}
+
+			var fields []string
+			for key := range msg.Header {
+				fields = append(fields, key)
+			}
+			sort.Strings(fields)
+			if got := strings.Join(fields, ","); got != "Received,Return-Path,Subject" {
+				t.Errorf("header fields = %s, want Received,Return-Path,Subject", got)
+			}
+			if got := msg.Header.Get("Subject"); got != "real" {
+				t.Errorf("Subject = %q, want %q", got, "real")
+			}
+
+			// Only the line endings written by traceHeaders remain
+			if lines := bytes.Count(trace, []byte("\n")); lines != bytes.Count(trace, []byte("\r\n")) {
+				t.Errorf("trace has a bare LF: %q", trace)
+			}
+			if bytes.Count(trace, []byte("\r")) != bytes.Count(trace, []byte("\r\n")) {
+				t.Errorf("trace has a bare CR: %q", trace)
+			}
+		})
+	}
+}
+
+func TestTraceComment(t *testing.T) {
+	if got, want := traceComment("a(b)c\\d\r\n"), `a\(b\)c\\d`; got != want {
+		t.Errorf("traceComment = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,67 @@
+package smtp
+
+import (
+	"bufio"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"nullmail/internal/faults"
+)
+
+// faultReplies holds the enhanced status code and default text of each
+// reply code a fault rule can send
+var faultReplies = map[int]struct{ status, message string }{
+	421: {StatusNotAccepting, MsgServiceUnavailable},
+	450: {StatusMailboxBusy, MsgMailboxBusy},
+	452: {StatusMailboxFull, MsgMailboxFull},
+	550: {StatusBadMailbox, MsgMailboxUnavailable},
+	552: {StatusMailboxFullPerm, MsgMailboxFullPerm},
+}
+
+// matchFault returns the fault rule that triggers for the current
+// transaction at stage
+func (s *SMTPServer) matchFault(stage, clientAddr string, session *SMTPSession, recipients ...string) (faults.Rule, bool) {
+	rule, ok := s.config.Faults.Match(stage, session.from, recipients...)
+	if ok {
+		slog.Info("Injecting SMTP fault", "client", clientAddr, "rule", rule.ID, "stage", stage, "from", session.from, "recipients", recipients)
+	}
+	return rule, ok
+}
+
+// applyFault waits for the rule's delay and then drops the connection or
+// sends the rule's reply. It reports whether the rule replaced the normal
+// reply, and like handleSMTPCommand returns 0 when the connection must be
+// closed.
+func (s *SMTPServer) applyFault(writer *bufio.Writer, rule faults.Rule) (int, bool) {
+	if rule.Delay > 0 {
+		timer := time.NewTimer(time.Duration(rule.Delay))
+		select {
+		case <-timer.C:
+		case <-s.quit:
+			timer.Stop()
+		}
+	}
+
+	if rule.Drop {
+		return 0, true
+	}
+	if rule.Code == 0 {
+		return 1, false
+	}
+
+	reply := faultReplies[rule.Code]
+	message := reply.message
+	if rule.Message != "" {
+		message = rule.Message
+	}
+	if rule.Code == 421 {
+		message = s.domains.hostname + " " + message
+	}
+	s.sendResponse(writer, strconv.Itoa(rule.Code), reply.status, message)
+
+	if rule.Code == 421 {
+		return 0, true
+	}
+	return 1, true
+}
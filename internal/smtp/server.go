@@ -2,132 +2,440 @@ package smtp
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"os"
-	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 	"unicode/utf8"
 
 	"nullmail/internal/email"
-	"nullmail/internal/redis"
+	"nullmail/internal/events"
+	"nullmail/internal/faults"
+	"nullmail/internal/ratelimit"
+	"nullmail/internal/storage"
 )
 
 type SMTPServer struct {
-	listener    net.Listener
+	mu          sync.Mutex
+	listener    net.Listener // plaintext listener
+	tlsListener net.Listener // implicit TLS listener, if serving SMTPS
 	quit        chan struct{}
+	sessions    map[*SMTPSession]struct{}
+	perIP       map[string]int // concurrent sessions by client IP
+	active      sync.WaitGroup
 	tlsConfig   *tls.Config
+	tlsErr      error // why the configured certificate could not be loaded
 	emailParser *email.EmailParser
 	validator   *email.EmailValidator
-	redisClient *redis.Client
+	domains     *domainPolicy
+	store       storage.Store
+	config      Config
 }
 
 type SMTPSession struct {
+	conn net.Conn // underlying connection, kept across STARTTLS
+
+	// busy is set while a command is being processed so that shutdown
+	// only interrupts sessions that are waiting for the next command
+	mu   sync.Mutex
+	busy bool
+
+	id          string // random, kept across STARTTLS
+	listener    string // ListenerSMTP or ListenerSMTPS
+	clientIP    string
+	rateLimited bool // the client exceeded the connection rate limit
 	isTLS       bool
+	tlsVersion  string
+	tlsCipher   string
+	heloName    string // set once the client has sent HELO or EHLO
+	extended    bool   // the greeting was EHLO
+	authUser    string
+	transcript  *transcript
+
+	// Mail transaction state, cleared by RSET, HELO/EHLO and after DATA
 	isUTF8      bool
 	messageSize int64
+	bodyType    string // BODY= parameter of MAIL, upper case
 	from        string
 	recipients  []string
+	chunking    bool         // a BDAT transfer has started
+	chunks      bytes.Buffer // message content received by BDAT so far
 }
 
-func NewSMTPServer(port string) *SMTPServer {
-	redisClient := redis.NewClientFromEnv()
+// Listener names recorded on stored messages
+const (
+	ListenerSMTP  = "smtp"
+	ListenerSMTPS = "smtps"
+)
+
+// tlsHandshakeTimeout bounds the handshake of implicit TLS connections
+const tlsHandshakeTimeout = 10 * time.Second
+
+// replyTimeout bounds writing the final 421 reply to a connection that is
+// over the session limits or has timed out
+const replyTimeout = 10 * time.Second
+
+// Reasons trackSession refuses a session
+var (
+	errServerClosed          = errors.New("server is shutting down")
+	errTooManySessions       = errors.New("too many concurrent sessions")
+	errTooManySessionsFromIP = errors.New("too many concurrent sessions from client address")
+)
+
+// errLineTooLong is returned by readLine for lines over the length limit
+var errLineTooLong = errors.New("line too long")
 
-	// Test Redis connection
-	if err := redisClient.Ping(); err != nil {
-		slog.Warn("Redis connection failed, continuing without Redis", "error", err)
-		redisClient = nil
+// recordTLS marks the session as encrypted and remembers the negotiated
+// parameters for stored messages
+func (session *SMTPSession) recordTLS(state tls.ConnectionState) {
+	session.isTLS = true
+	session.tlsVersion = tls.VersionName(state.Version)
+	session.tlsCipher = tls.CipherSuiteName(state.CipherSuite)
+}
+
+// resetTransaction clears the envelope so the next message starts fresh
+func (session *SMTPSession) resetTransaction() {
+	session.isUTF8 = false
+	session.messageSize = 0
+	session.bodyType = ""
+	session.from = ""
+	session.recipients = nil
+	session.chunking = false
+	session.chunks.Reset()
+}
+
+// NewSMTPServer creates a server that persists messages to the given store
+func NewSMTPServer(store storage.Store, config Config) *SMTPServer {
+	config.Limits = config.Limits.withDefaults()
+	if config.RateLimit.Limiter == nil {
+		config.RateLimit.Limiter = ratelimit.NewMemoryLimiter()
 	}
 
+	domains := newDomainPolicy(config.Domains)
+	tlsConfig, tlsErr := loadTLSConfig(config.TLS, domains.certHosts())
+
 	return &SMTPServer{
 		quit:        make(chan struct{}),
-		tlsConfig:   loadOrGenerateTLSConfig(),
+		sessions:    make(map[*SMTPSession]struct{}),
+		perIP:       make(map[string]int),
+		tlsConfig:   tlsConfig,
+		tlsErr:      tlsErr,
 		emailParser: email.NewEmailParser(),
 		validator:   email.NewEmailValidator(),
-		redisClient: redisClient,
+		domains:     domains,
+		store:       store,
+		config:      config,
 	}
 }
 
 func (s *SMTPServer) Start(port string) error {
-	var err error
-
-	s.listener, err = net.Listen("tcp", port)
-
+	listener, err := net.Listen("tcp", port)
 	if err != nil {
 		return fmt.Errorf("failed to start listener on port %s: %v", port, err)
 	}
 
-	slog.Info("SMTP server started", "port", port)
+	return s.Serve(listener)
+}
+
+// Err returns the configuration error that keeps the server from serving,
+// such as a configured TLS certificate that cannot be loaded
+func (s *SMTPServer) Err() error {
+	return s.tlsErr
+}
 
-	// handle gracefull shutdown
-	go s.handleShutdown()
+// Serve accepts connections on the listener until Shutdown is called. It
+// fails immediately if Err reports a configuration error.
+func (s *SMTPServer) Serve(listener net.Listener) error {
+	return s.serve(listener, ListenerSMTP)
+}
+
+// ServeTLS accepts implicit TLS (SMTPS) connections on the listener until
+// Shutdown is called. Sessions are encrypted from the first byte and share
+// the handling of plaintext sessions.
+func (s *SMTPServer) ServeTLS(listener net.Listener) error {
+	if s.tlsErr != nil {
+		listener.Close()
+		return s.tlsErr
+	}
+	if s.tlsConfig == nil {
+		listener.Close()
+		return fmt.Errorf("implicit TLS requires a TLS configuration")
+	}
+	return s.serve(tls.NewListener(listener, s.tlsConfig), ListenerSMTPS)
+}
+
+func (s *SMTPServer) serve(listener net.Listener, name string) error {
+	if s.tlsErr != nil {
+		listener.Close()
+		return s.tlsErr
+	}
+
+	s.mu.Lock()
+	select {
+	case <-s.quit:
+		s.mu.Unlock()
+		listener.Close()
+		return nil
+	default:
+	}
+	if name == ListenerSMTPS {
+		s.tlsListener = listener
+	} else {
+		s.listener = listener
+	}
+	s.mu.Unlock()
+
+	slog.Info("SMTP server started", "addr", listener.Addr().String(), "listener", name)
 
 	for {
-		select {
-		case <-s.quit:
-			return nil
-		default:
-			conn, err := s.listener.Accept()
-
-			if err != nil {
-				select {
-				case <-s.quit:
-					return nil
-				default:
-					slog.Error("Error accepting connection", "error", err)
-					continue
-				}
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-s.quit:
+				return nil
+			default:
+				slog.Error("Error accepting connection", "error", err)
+				continue
 			}
+		}
 
-			// handle connection
-			go s.handleConnection(conn, &SMTPSession{})
+		session := &SMTPSession{conn: conn, id: newSessionID(), listener: name, clientIP: remoteIP(conn)}
+		switch err := s.trackSession(session); err {
+		case nil:
+			go s.handleConnection(conn, session)
+		case errServerClosed:
+			conn.Close()
+			return nil
+		case errTooManySessions:
+			slog.Warn("Rejecting connection, session limit reached", "client", conn.RemoteAddr().String(), "limit", s.config.Limits.MaxSessions)
+			go s.rejectConnection(conn, StatusNotAccepting, s.domains.hostname+" "+MsgTooManySessions)
+		default:
+			slog.Warn("Rejecting connection, per-IP session limit reached", "client", conn.RemoteAddr().String(), "limit", s.config.Limits.MaxSessionsPerIP)
+			go s.rejectConnection(conn, StatusPolicy, s.domains.hostname+" "+MsgTooManySessionsFromIP)
 		}
 	}
+}
+
+// trackSession registers a session for draining and counts it against the
+// session limits. It fails once shutdown has started or a limit is reached.
+func (s *SMTPServer) trackSession(session *SMTPSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.quit:
+		return errServerClosed
+	default:
+	}
 
+	limits := s.config.Limits
+	if limits.MaxSessions > 0 && len(s.sessions) >= limits.MaxSessions {
+		return errTooManySessions
+	}
+	if limits.MaxSessionsPerIP > 0 && s.perIP[session.clientIP] >= limits.MaxSessionsPerIP {
+		return errTooManySessionsFromIP
+	}
+
+	s.sessions[session] = struct{}{}
+	s.perIP[session.clientIP]++
+	s.active.Add(1)
+	return nil
+}
+
+func (s *SMTPServer) untrackSession(session *SMTPSession) {
+	s.mu.Lock()
+	delete(s.sessions, session)
+	if s.perIP[session.clientIP]--; s.perIP[session.clientIP] <= 0 {
+		delete(s.perIP, session.clientIP)
+	}
+	s.mu.Unlock()
+	s.active.Done()
 }
 
-func (s *SMTPServer) handleShutdown() {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+// rejectConnection answers a connection that is over the session limits
+// with 421 and closes it
+func (s *SMTPServer) rejectConnection(conn net.Conn, status, message string) {
+	defer conn.Close()
 
-	slog.Info("SMTP server shutting down")
+	conn.SetDeadline(time.Now().Add(replyTimeout))
+	writer := bufio.NewWriter(conn)
+	s.sendResponse(writer, CodeServiceNotAvailable, status, message)
+	writer.Flush()
+}
+
+// remoteIP returns the IP address of the client without the port
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func (s *SMTPServer) isShuttingDown() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Addr returns the address the server is listening on, or nil before Serve
+func (s *SMTPServer) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// TLSAddr returns the implicit TLS address, or nil before ServeTLS
+func (s *SMTPServer) TLSAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tlsListener == nil {
+		return nil
+	}
+	return s.tlsListener.Addr()
+}
+
+// Shutdown stops accepting connections and waits for in-flight sessions to
+// finish. Idle sessions are answered with 421 and closed; sessions in the
+// middle of a command are allowed to complete it first. If ctx expires
+// before every session has ended, the remaining connections are closed and
+// ctx.Err() is returned.
+func (s *SMTPServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	select {
+	case <-s.quit:
+		s.mu.Unlock()
+		return nil
+	default:
+	}
+
+	slog.Info("SMTP server shutting down", "sessions", len(s.sessions))
 	close(s.quit)
 	if s.listener != nil {
 		s.listener.Close()
 	}
-	if s.redisClient != nil {
-		s.redisClient.Close()
+	if s.tlsListener != nil {
+		s.tlsListener.Close()
+	}
+
+	// Wake sessions blocked waiting for a command
+	for session := range s.sessions {
+		session.mu.Lock()
+		if !session.busy {
+			session.conn.SetReadDeadline(time.Now())
+		}
+		session.mu.Unlock()
+	}
+	s.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		slog.Info("All SMTP sessions drained")
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		slog.Warn("Shutdown deadline exceeded, closing remaining SMTP sessions", "sessions", len(s.sessions))
+		for session := range s.sessions {
+			session.conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
 	}
 }
 
 func (s *SMTPServer) handleConnection(conn net.Conn, session *SMTPSession) {
-	s.handleConnectionWithoutClose(conn, session)
-	conn.Close()
+	defer s.untrackSession(session)
+	defer conn.Close()
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// Implicit TLS: complete the handshake before greeting. Shutdown
+		// interrupts it through the read deadline like an idle session.
+		tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			slog.Debug("TLS handshake failed", "error", err, "client", conn.RemoteAddr().String())
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		session.recordTLS(tlsConn.ConnectionState())
+	}
+	session.transcript = newTranscript(session)
+	defer s.saveTranscript(session)
+
+	slog.Info("New SMTP connection", "client", conn.RemoteAddr().String(), "session", session.id, "listener", session.listener, "tls", session.isTLS)
+
+	if !s.allowRate("conn:"+session.clientIP, s.config.RateLimit.ConnectionsPerIP) {
+		slog.Warn("Connection rate limit exceeded", "client", conn.RemoteAddr().String(), "limit", s.config.RateLimit.ConnectionsPerIP)
+		session.rateLimited = true
+	}
+	s.handleConnectionWithoutClose(conn, session, true)
 }
 
-func (s *SMTPServer) handleConnectionWithoutClose(conn net.Conn, session *SMTPSession) {
+// handleConnectionWithoutClose runs the command loop on conn. greet is false
+// when continuing a session after STARTTLS, where no new banner is sent.
+func (s *SMTPServer) handleConnectionWithoutClose(conn net.Conn, session *SMTPSession, greet bool) {
 	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
+	writer := bufio.NewWriter(session.transcript.writer(conn))
 
 	clientAddr := conn.RemoteAddr().String()
 
-	if !session.isTLS {
-		slog.Info("New SMTP connection", "client", clientAddr)
-		s.sendResponse(writer, CodeServiceReady, MsgServiceReady)
+	if greet {
+		s.sendResponse(writer, CodeServiceReady, "", s.domains.hostname+" "+MsgServiceReady)
 	}
 
 	for {
-		line, err := reader.ReadString('\n')
+		// Set before the session is marked idle, so that the deadline set
+		// by Shutdown to wake idle sessions cannot be overwritten
+		conn.SetDeadline(time.Now().Add(s.config.Limits.CommandTimeout))
+
+		if !s.setSessionBusy(session, false) {
+			s.sendResponse(writer, CodeServiceNotAvailable, StatusNotAccepting, s.domains.hostname+" "+MsgServiceShuttingDown)
+			break
+		}
+
+		s.flushIfIdle(reader, writer)
+		line, err := readLine(reader, MaxCommandLineLength)
+
+		if err == errLineTooLong {
+			session.transcript.client("[line too long]")
+			slog.Warn("Command line too long", "client", clientAddr, "limit", MaxCommandLineLength)
+			s.sendResponse(writer, CodeCommandNotRecognized, StatusCommandUnrecognized, MsgLineTooLong)
+			continue
+		}
 
 		if err != nil {
 			// Handle different types of connection errors more gracefully
-			if err == io.EOF {
+			if s.isShuttingDown() {
+				s.sendResponse(writer, CodeServiceNotAvailable, StatusNotAccepting, s.domains.hostname+" "+MsgServiceShuttingDown)
+			} else if errors.Is(err, os.ErrDeadlineExceeded) {
+				slog.Info("Client timed out waiting for command", "client", clientAddr, "timeout", s.config.Limits.CommandTimeout)
+				conn.SetWriteDeadline(time.Now().Add(replyTimeout))
+				s.sendResponse(writer, CodeServiceNotAvailable, StatusTimeout, s.domains.hostname+" "+MsgTimeout)
+			} else if err == io.EOF {
 				slog.Debug("Client disconnected", "client", clientAddr)
 			} else if netErr, ok := err.(*net.OpError); ok && netErr.Err == syscall.ECONNRESET {
 				slog.Debug("Connection reset by client (likely health check)", "client", clientAddr)
@@ -137,7 +445,13 @@ func (s *SMTPServer) handleConnectionWithoutClose(conn net.Conn, session *SMTPSe
 			break
 		}
 
+		if !s.setSessionBusy(session, true) {
+			s.sendResponse(writer, CodeServiceNotAvailable, StatusNotAccepting, s.domains.hostname+" "+MsgServiceShuttingDown)
+			break
+		}
+
 		command := strings.TrimSpace(line)
+		session.transcript.command(command)
 		slog.Debug("Received SMTP command", "client", clientAddr, "command", command)
 
 		result := s.handleSMTPCommand(command, reader, writer, clientAddr, session, conn)
@@ -151,14 +465,79 @@ func (s *SMTPServer) handleConnectionWithoutClose(conn net.Conn, session *SMTPSe
 		// result == 1 means continue
 	}
 
+	writer.Flush()
+
 	slog.Info("SMTP connection closed", "client", clientAddr)
 }
 
+// allowRate takes a rate limit token for key. It fails open when the
+// limiter is unavailable, so a Redis outage does not stop mail.
+func (s *SMTPServer) allowRate(key string, limit ratelimit.Limit) bool {
+	allowed, err := s.config.RateLimit.Limiter.Allow(key, limit)
+	if err != nil {
+		slog.Warn("Rate limiter unavailable, allowing", "key", key, "error", err)
+		return true
+	}
+	return allowed
+}
+
+// allowMessage applies the sender rate limit to the current transaction
+func (s *SMTPServer) allowMessage(clientAddr string, session *SMTPSession) bool {
+	if s.allowRate("sender:"+strings.ToLower(session.from), s.config.RateLimit.MessagesPerSender) {
+		return true
+	}
+	slog.Warn("Sender rate limit exceeded", "client", clientAddr, "from", session.from, "limit", s.config.RateLimit.MessagesPerSender)
+	return false
+}
+
+// readLine reads a line of at most limit octets including the line ending.
+// A longer line is consumed up to its end and reported as errLineTooLong
+// without being buffered, so the session can continue with the next line.
+func readLine(reader *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	tooLong := false
+
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !tooLong {
+			line = append(line, chunk...)
+			if len(line) > limit {
+				tooLong = true
+				line = nil
+			}
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+
+	if tooLong {
+		return "", errLineTooLong
+	}
+	return string(line), nil
+}
+
+// setSessionBusy marks whether the session is processing a command. It
+// returns false once shutdown has started, in which case the next command
+// must not be processed.
+func (s *SMTPServer) setSessionBusy(session *SMTPSession, busy bool) bool {
+	session.mu.Lock()
+	session.busy = busy
+	session.mu.Unlock()
+
+	return !s.isShuttingDown()
+}
+
 func (s *SMTPServer) handleSMTPCommand(command string, reader *bufio.Reader, writer *bufio.Writer, clientAddr string, session *SMTPSession, conn net.Conn) int {
 	parts := strings.Fields(strings.ToUpper(command))
 
 	if len(parts) == 0 {
-		s.sendResponse(writer, CodeCommandNotRecognized, MsgCommandNotRecognized)
+		s.sendResponse(writer, CodeCommandNotRecognized, StatusCommandUnrecognized, MsgCommandNotRecognized)
 		return 1
 	}
 
@@ -166,22 +545,25 @@ func (s *SMTPServer) handleSMTPCommand(command string, reader *bufio.Reader, wri
 
 	switch cmd {
 	case "HELO", "EHLO":
-		s.handleHelo(cmd, parts, writer, session)
+		s.handleHelo(cmd, command, writer, session)
 	case "MAIL":
 		s.handleMail(command, writer, session)
 	case "RCPT":
-		s.handleRcpt(command, writer, session)
+		return s.handleRcpt(command, writer, clientAddr, session)
 	case "DATA":
-		s.handleData(reader, writer, clientAddr, session)
+		return s.handleData(reader, writer, clientAddr, session)
+	case "BDAT":
+		return s.handleBdat(command, reader, writer, clientAddr, session)
 	case "QUIT":
-		s.sendResponse(writer, CodeServiceClosing, MsgServiceClosing)
+		s.sendResponse(writer, CodeServiceClosing, StatusOK, MsgServiceClosing)
 		return 0
 	case "RSET":
-		s.sendResponse(writer, CodeOK, MsgOK)
+		session.resetTransaction()
+		s.sendResponse(writer, CodeOK, StatusOK, MsgOK)
 	case "NOOP":
-		s.sendResponse(writer, CodeOK, MsgOK)
+		s.sendResponse(writer, CodeOK, StatusOK, MsgOK)
 	case "AUTH":
-		s.handleAuth(command, writer)
+		s.handleAuth(command, reader, writer, session)
 	case "VRFY":
 		s.handleVrfy(command, writer)
 	case "EXPN":
@@ -189,55 +571,102 @@ func (s *SMTPServer) handleSMTPCommand(command string, reader *bufio.Reader, wri
 	case "HELP":
 		s.handleHelp(writer)
 	case "STARTTLS":
-		return s.handleStartTLS(writer, conn, session)
+		return s.handleStartTLS(reader, writer, conn, session)
 	default:
-		s.sendResponse(writer, CodeCommandNotImplemented, MsgCommandNotImplemented)
+		s.sendResponse(writer, CodeCommandNotImplemented, StatusInvalidCommand, MsgCommandNotImplemented)
 	}
 
 	return 1
 }
 
-func (s *SMTPServer) sendResponse(writer *bufio.Writer, code, message string) {
-	response := fmt.Sprintf("%s %s\r\n", code, message)
-	writer.WriteString(response)
-	writer.Flush()
-	slog.Debug("Sent SMTP response", "code", code, "message", message)
+// sendResponse queues a reply. status is the RFC 3463 enhanced status code,
+// left empty for the greeting, HELO/EHLO and intermediate replies. Replies
+// are flushed by flushIfIdle once the client has no more pipelined commands
+// waiting, so a batch of commands gets its replies in a single write (RFC 2920).
+func (s *SMTPServer) sendResponse(writer *bufio.Writer, code, status, message string) {
+	s.sendMultiline(writer, code, status, []string{message})
+}
+
+// sendMultiline queues a reply of several lines, each carrying the same
+// codes, with "-" after the reply code on every line but the last
+func (s *SMTPServer) sendMultiline(writer *bufio.Writer, code, status string, lines []string) {
+	for i, line := range lines {
+		separator := "-"
+		if i == len(lines)-1 {
+			separator = " "
+		}
+		if status != "" {
+			line = status + " " + line
+		}
+		writer.WriteString(code + separator + line + "\r\n")
+	}
+	slog.Debug("Sent SMTP response", "code", code, "status", status, "lines", lines)
+}
+
+// flushIfIdle sends queued replies when no further input is buffered, i.e.
+// right before the server would block waiting for the client
+func (s *SMTPServer) flushIfIdle(reader *bufio.Reader, writer *bufio.Writer) {
+	if reader.Buffered() == 0 {
+		writer.Flush()
+	}
 }
 
-func (s *SMTPServer) handleHelo(cmd string, parts []string, writer *bufio.Writer, session *SMTPSession) {
+func (s *SMTPServer) handleHelo(cmd, command string, writer *bufio.Writer, session *SMTPSession) {
+	parts := strings.Fields(command)
 	if len(parts) < 2 {
-		s.sendResponse(writer, CodeSyntaxError, MsgSyntaxError)
+		s.sendResponse(writer, CodeSyntaxError, StatusInvalidParameters, MsgSyntaxError)
 		return
 	}
 
+	// A new greeting aborts any transaction in progress (RFC 5321 4.1.4)
+	session.resetTransaction()
+	session.heloName = parts[1]
+	session.extended = cmd == "EHLO"
+
 	if cmd == "EHLO" {
-		// EHLO multi-line response format with dynamic size
-		ehloResponse := fmt.Sprintf(EHLOGreetingTemplate, MaxMessageSize)
-		writer.WriteString(ehloResponse)
-		writer.Flush()
-		slog.Debug("Sent EHLO response")
+		s.sendMultiline(writer, CodeOK, "", ehloLines(s.domains.hostname, s.tlsConfig != nil && !session.isTLS))
 	} else {
-		s.sendResponse(writer, CodeOK, DefaultHostname)
+		s.sendResponse(writer, CodeOK, "", s.domains.hostname)
 	}
 }
 
 func (s *SMTPServer) handleMail(cmd string, writer *bufio.Writer, session *SMTPSession) {
+	if session.heloName == "" {
+		s.sendResponse(writer, CodeBadSequence, StatusInvalidCommand, MsgHeloFirst)
+		return
+	}
+
+	if session.from != "" {
+		s.sendResponse(writer, CodeBadSequence, StatusInvalidCommand, MsgSenderAlreadySpecified)
+		return
+	}
+
+	if s.config.TLS.Require && !session.isTLS {
+		s.sendResponse(writer, CodeTLSRequired, StatusTLSRequired, MsgTLSRequired)
+		return
+	}
+
+	if session.rateLimited {
+		s.sendResponse(writer, CodeMailboxUnavailable, StatusRateLimit, MsgConnectionRateExceeded)
+		return
+	}
+
 	upper := strings.ToUpper(cmd)
 	if !strings.Contains(upper, "FROM:") {
-		s.sendResponse(writer, CodeSyntaxError, MsgSyntaxError)
+		s.sendResponse(writer, CodeSyntaxError, StatusInvalidParameters, MsgSyntaxError)
 		return
 	}
 
 	emailAddr := s.extractEmailFromCommand(cmd, "FROM:")
 	if emailAddr == "" {
-		s.sendResponse(writer, CodeSyntaxError, "Invalid MAIL FROM syntax")
+		s.sendResponse(writer, CodeSyntaxError, StatusBadSenderSyntax, "Invalid MAIL FROM syntax")
 		return
 	}
 
 	// Validate the email address
 	if result := s.validator.ValidateAddress(emailAddr); !result.Valid {
 		slog.Warn("Invalid FROM address", "address", emailAddr, "errors", result.Errors)
-		s.sendResponse(writer, CodeSyntaxError, "Invalid FROM address: "+result.Errors[0].Message)
+		s.sendResponse(writer, CodeSyntaxError, StatusBadSenderSyntax, "Invalid FROM address: "+result.Errors[0].Message)
 		return
 	}
 
@@ -248,11 +677,11 @@ func (s *SMTPServer) handleMail(cmd string, writer *bufio.Writer, session *SMTPS
 			if sizeStr, found := strings.CutPrefix(strings.ToUpper(part), "SIZE="); found {
 				size, err := strconv.ParseInt(sizeStr, 10, 64)
 				if err != nil {
-					s.sendResponse(writer, CodeSyntaxError, MsgSyntaxError)
+					s.sendResponse(writer, CodeSyntaxError, StatusInvalidParameters, MsgSyntaxError)
 					return
 				}
 				if size > MaxMessageSize {
-					s.sendResponse(writer, CodeMessageTooLarge, MsgMessageTooLarge)
+					s.sendResponse(writer, CodeMessageTooLarge, StatusMessageTooLarge, MsgMessageTooLarge)
 					return
 				}
 				session.messageSize = size
@@ -260,6 +689,19 @@ func (s *SMTPServer) handleMail(cmd string, writer *bufio.Writer, session *SMTPS
 		}
 	}
 
+	// Parse BODY parameter (RFC 6152, RFC 3030)
+	for _, part := range strings.Fields(cmd) {
+		if bodyType, found := strings.CutPrefix(strings.ToUpper(part), "BODY="); found {
+			switch bodyType {
+			case "7BIT", "8BITMIME", "BINARYMIME":
+				session.bodyType = bodyType
+			default:
+				s.sendResponse(writer, CodeParameterNotImplemented, StatusInvalidParameters, MsgBodyTypeUnsupported)
+				return
+			}
+		}
+	}
+
 	// Check for SMTPUTF8
 	if strings.Contains(upper, "SMTPUTF8") {
 		session.isUTF8 = true
@@ -268,7 +710,7 @@ func (s *SMTPServer) handleMail(cmd string, writer *bufio.Writer, session *SMTPS
 	// Validate UTF-8 if SMTPUTF8 is enabled
 	if session.isUTF8 {
 		if !utf8.ValidString(cmd) {
-			s.sendResponse(writer, CodeSyntaxError, "Invalid UTF-8")
+			s.sendResponse(writer, CodeSyntaxError, StatusBadSenderSyntax, "Invalid UTF-8")
 			return
 		}
 	}
@@ -276,80 +718,188 @@ func (s *SMTPServer) handleMail(cmd string, writer *bufio.Writer, session *SMTPS
 	// Store the validated FROM address in session
 	session.from = emailAddr
 	slog.Debug("MAIL FROM accepted", "address", emailAddr)
-	s.sendResponse(writer, CodeOK, MsgOK)
+	s.sendResponse(writer, CodeOK, StatusSenderOK, MsgOK)
 }
 
-func (s *SMTPServer) handleRcpt(cmd string, writer *bufio.Writer, session *SMTPSession) {
+func (s *SMTPServer) handleRcpt(cmd string, writer *bufio.Writer, clientAddr string, session *SMTPSession) int {
+	if session.from == "" {
+		s.sendResponse(writer, CodeBadSequence, StatusInvalidCommand, MsgNeedMail)
+		return 1
+	}
+
 	if !strings.Contains(strings.ToUpper(cmd), "TO:") {
-		s.sendResponse(writer, CodeSyntaxError, MsgSyntaxError)
-		return
+		s.sendResponse(writer, CodeSyntaxError, StatusInvalidParameters, MsgSyntaxError)
+		return 1
 	}
 
 	emailAddr := s.extractEmailFromCommand(cmd, "TO:")
 	if emailAddr == "" {
-		s.sendResponse(writer, CodeSyntaxError, "Invalid RCPT TO syntax")
-		return
+		s.sendResponse(writer, CodeSyntaxError, StatusBadRecipientSyntax, "Invalid RCPT TO syntax")
+		return 1
 	}
 
 	if result := s.validator.ValidateAddress(emailAddr); !result.Valid {
 		slog.Warn("Invalid TO address", "address", emailAddr, "errors", result.Errors)
-		s.sendResponse(writer, CodeSyntaxError, "Invalid TO address: "+result.Errors[0].Message)
-		return
+		s.sendResponse(writer, CodeSyntaxError, StatusBadRecipientSyntax, "Invalid TO address: "+result.Errors[0].Message)
+		return 1
 	}
 
-	if session.recipients == nil {
-		session.recipients = []string{}
+	if !s.domains.isLocal(emailAddr) {
+		slog.Info("Rejecting recipient on a foreign domain", "address", emailAddr)
+		s.sendResponse(writer, CodeUserNotLocal, StatusBadMailbox, MsgDomainNotLocal)
+		return 1
 	}
+
+	if rule, faulted := s.matchFault(faults.StageRcpt, clientAddr, session, emailAddr); faulted {
+		if result, replied := s.applyFault(writer, rule); replied {
+			return result
+		}
+	}
+
+	if !s.allowRate("rcpt:"+strings.ToLower(emailAddr), s.config.RateLimit.MessagesPerRecipient) {
+		slog.Warn("Recipient rate limit exceeded", "address", emailAddr, "limit", s.config.RateLimit.MessagesPerRecipient)
+		s.sendResponse(writer, CodeInsufficientStorage, StatusRecipientRateLimit, MsgRecipientRateExceeded)
+		return 1
+	}
+
 	session.recipients = append(session.recipients, emailAddr)
 	slog.Debug("RCPT TO accepted", "address", emailAddr)
-	s.sendResponse(writer, CodeOK, MsgOK)
+	s.sendResponse(writer, CodeOK, StatusRecipientOK, MsgOK)
+	return 1
 }
 
-func (s *SMTPServer) handleData(reader *bufio.Reader, writer *bufio.Writer, clientAddr string, session *SMTPSession) {
-	s.sendResponse(writer, CodeStartMailInput, MsgStartMailInput)
+// handleData receives a message after DATA. Like handleSMTPCommand it
+// returns 0 when the connection must be closed.
+func (s *SMTPServer) handleData(reader *bufio.Reader, writer *bufio.Writer, clientAddr string, session *SMTPSession) int {
+	if session.from == "" {
+		s.sendResponse(writer, CodeBadSequence, StatusInvalidCommand, MsgNeedMail)
+		return 1
+	}
+
+	if len(session.recipients) == 0 {
+		s.sendResponse(writer, CodeBadSequence, StatusInvalidCommand, MsgNeedRcpt)
+		return 1
+	}
+
+	if session.bodyType == "BINARYMIME" {
+		s.sendResponse(writer, CodeBadSequence, StatusInvalidCommand, MsgBinaryMIMERequiresBdat)
+		return 1
+	}
+
+	if session.chunking {
+		s.sendResponse(writer, CodeBadSequence, StatusInvalidCommand, MsgBdatInProgress)
+		return 1
+	}
+
+	if s.store == nil {
+		slog.Warn("Rejecting DATA, no storage available", "client", clientAddr)
+		s.sendResponse(writer, CodeRequestedActionAborted, StatusLocalError, MsgStorageUnavailable)
+		return 1
+	}
 
-	var emailContent strings.Builder
+	if !s.allowMessage(clientAddr, session) {
+		s.sendResponse(writer, CodeMailboxUnavailable, StatusRateLimit, MsgSenderRateExceeded)
+		return 1
+	}
+
+	rule, faulted := s.matchFault(faults.StageData, clientAddr, session, session.recipients...)
+
+	s.sendResponse(writer, CodeStartMailInput, "", MsgStartMailInput)
+
+	// Whatever the outcome, the envelope belongs to this message only
+	defer session.resetTransaction()
+
+	// Message content is handled as bytes: 8BITMIME and legacy mail can carry
+	// data in any charset, which is decoded later by the parser
+	var emailContent bytes.Buffer
 	var totalSize int64
+	tooLarge := false
 
 	for {
-		line, err := reader.ReadString('\n')
+		s.flushIfIdle(reader, writer)
+		session.conn.SetDeadline(time.Now().Add(s.config.Limits.DataTimeout))
+		// A line may use the rest of the size budget, plus room for the
+		// terminating dot or a stuffed one; anything longer is discarded
+		// without being buffered
+		limit := MaxMessageSize - int(totalSize) + len(".\r\n")
+		if limit < len(".\r\n") {
+			limit = len(".\r\n")
+		}
+		text, err := readLine(reader, limit)
+		if err == errLineTooLong {
+			totalSize += int64(limit)
+			tooLarge = true
+			continue
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			slog.Info("Client timed out sending message data", "client", clientAddr, "timeout", s.config.Limits.DataTimeout)
+			session.conn.SetWriteDeadline(time.Now().Add(replyTimeout))
+			s.sendResponse(writer, CodeServiceNotAvailable, StatusTimeout, s.domains.hostname+" "+MsgTimeout)
+			return 0
+		}
 		if err != nil {
 			slog.Error("Error reading email data", "error", err, "client", clientAddr)
-			s.sendResponse(writer, CodeRequestedActionAborted, MsgRequestedActionAborted)
-			return
+			s.sendResponse(writer, CodeRequestedActionAborted, StatusLocalError, MsgRequestedActionAborted)
+			return 0
 		}
 
-		if strings.TrimSpace(line) == "." {
+		line := []byte(text)
+
+		if faulted && rule.Drop {
+			slog.Info("Dropping connection mid-DATA", "client", clientAddr, "rule", rule.ID)
+			result, _ := s.applyFault(writer, rule)
+			return result
+		}
+
+		// End of data is a line holding a single dot
+		if bytes.Equal(line, []byte(".\r\n")) || bytes.Equal(line, []byte(".\n")) {
 			break
 		}
 
-		if strings.HasPrefix(line, "..") {
+		if bytes.HasPrefix(line, []byte("..")) {
 			line = line[1:]
 		}
 
-		// Check size limits
+		// Past the size limit the rest of the message is read and
+		// discarded, so that it is not taken for commands
 		totalSize += int64(len(line))
 		if totalSize > MaxMessageSize {
-			slog.Error("Message too large", "size", totalSize, "limit", MaxMessageSize)
-			s.sendResponse(writer, CodeMessageTooLarge, MsgMessageTooLarge)
-			return
+			tooLarge = true
+			continue
 		}
 
-		// Validate UTF-8 if SMTPUTF8 mode
-		if session.isUTF8 && !utf8.ValidString(line) {
-			slog.Error("Invalid UTF-8 in message", "client", clientAddr)
-			s.sendResponse(writer, CodeSyntaxError, MsgInvalidUTF)
-			return
-		}
+		emailContent.Write(line)
+	}
+	session.transcript.content(emailContent.Bytes())
 
-		emailContent.WriteString(line)
+	if tooLarge {
+		slog.Error("Message too large", "size", totalSize, "limit", MaxMessageSize)
+		s.sendResponse(writer, CodeMessageTooLarge, StatusMessageTooLarge, MsgMessageTooLarge)
+		return 1
 	}
 
-	rawEmail := emailContent.String()
-	parseResult, err := s.emailParser.ParseEmail(rawEmail)
+	if faulted {
+		if result, replied := s.applyFault(writer, rule); replied {
+			return result
+		}
+	}
+
+	s.deliverMessage(writer, clientAddr, session, emailContent.Bytes())
+	return 1
+}
+
+// deliverMessage parses a complete message received by DATA or BDAT with
+// trace headers added, stores it and sends the final reply
+func (s *SMTPServer) deliverMessage(writer *bufio.Writer, clientAddr string, session *SMTPSession, rawEmail []byte) {
+	envelope := session.envelope()
+	trace := traceHeaders(envelope, s.domains.hostname, time.Now())
+
+	// Parse the message as a downstream MTA would see it, but store the
+	// payload untouched
+	parseResult, err := s.emailParser.ParseEmail(append(trace, rawEmail...))
 	if err != nil {
 		slog.Error("Failed to parse email", "error", err, "client", clientAddr)
-		s.sendResponse(writer, CodeRequestedActionAborted, "Failed to parse email")
+		s.sendResponse(writer, CodeRequestedActionAborted, StatusLocalError, "Failed to parse email")
 		return
 	}
 
@@ -364,62 +914,109 @@ func (s *SMTPServer) handleData(reader *bufio.Reader, writer *bufio.Writer, clie
 		"from", session.from,
 		"recipients", session.recipients,
 		"subject", parseResult.Email.Subject,
-		"size", emailContent.Len(),
+		"size", len(rawEmail),
 		"attachments", len(parseResult.Email.Attachments))
 
-	if s.redisClient != nil {
-		if err := s.storeEmailInRedis(parseResult.Email, session); err != nil {
-			slog.Error("Failed to store email in Redis", "error", err, "id", parseResult.Email.ID)
-		}
-	} else {
-		slog.Debug("Redis not available, email not stored")
+	if err := s.storeEmail(parseResult.Email, rawEmail, trace, envelope); err != nil {
+		slog.Error("Failed to store email", "error", err, "id", parseResult.Email.ID)
+		s.sendResponse(writer, CodeRequestedActionAborted, StatusLocalError, MsgStorageUnavailable)
+		return
 	}
 
 	slog.Debug("Parsed email structure", "email", parseResult.Email)
-	s.sendResponse(writer, CodeOK, MsgMessageAccepted)
+	s.publishReceived(parseResult.Email, envelope)
+
+	// Store the transcript so far before accepting, so that the message
+	// links to a transcript as soon as the client sees the reply. The
+	// complete transcript replaces it when the session ends.
+	session.transcript.linkMessage(parseResult.Email.ID)
+	if err := s.store.SaveTranscript(session.transcript.snapshot(false)); err != nil {
+		slog.Warn("Failed to store session transcript", "error", err, "session", session.id)
+	}
+
+	s.sendResponse(writer, CodeOK, StatusOK, MsgMessageAccepted)
 }
 
-func (s *SMTPServer) handleAuth(_cmd string, writer *bufio.Writer) {
-	s.sendResponse(writer, CodeAuthSuccessful, MsgAuthSuccessful)
+// publishReceived notifies subscribers of a stored message. Failures are
+// logged only; the message is stored either way.
+func (s *SMTPServer) publishReceived(parsedEmail *email.Email, envelope *storage.Envelope) {
+	if s.config.Events == nil {
+		return
+	}
+
+	event := events.Event{
+		Type:       events.TypeMessageReceived,
+		ID:         parsedEmail.ID,
+		From:       envelope.MailFrom,
+		Recipients: envelope.RcptTo,
+		Subject:    parsedEmail.Subject,
+		ReceivedAt: parsedEmail.ReceivedAt,
+	}
+	if err := s.config.Events.Publish(event); err != nil {
+		slog.Warn("Failed to publish message event", "error", err, "id", parsedEmail.ID)
+	}
+}
+
+// saveTranscript stores the final transcript of a session. Connections that
+// never sent a command, such as health checks, are not recorded.
+func (s *SMTPServer) saveTranscript(session *SMTPSession) {
+	if s.store == nil || session.transcript.commands == 0 {
+		return
+	}
+	if err := s.store.SaveTranscript(session.transcript.snapshot(true)); err != nil {
+		slog.Warn("Failed to store session transcript", "error", err, "session", session.id)
+	}
 }
 
 func (s *SMTPServer) handleVrfy(cmd string, writer *bufio.Writer) {
 	parts := strings.Fields(cmd)
 	if len(parts) < 2 {
-		s.sendResponse(writer, CodeSyntaxError, MsgSyntaxError)
+		s.sendResponse(writer, CodeSyntaxError, StatusInvalidParameters, MsgSyntaxError)
 		return
 	}
 
-	// For disposable email service, we can't really verify users
-	// but we accept all addresses ending with our domain
-	email := parts[1]
-	if strings.Contains(email, "@nullmail.local") || strings.Contains(email, "@nullmail.nitin.sh") {
-		s.sendResponse(writer, CodeOK, fmt.Sprintf("250 %s", email))
-	} else {
-		s.sendResponse(writer, CodeCannotVerify, MsgCannotVerify)
+	// A disposable inbox exists as soon as mail arrives, so every address
+	// on a local domain is deliverable. In catch-all mode there is no list
+	// to check against.
+	address := strings.Trim(parts[1], "<>")
+	switch {
+	case s.domains.catchAll():
+		s.sendResponse(writer, CodeCannotVerify, StatusOK, MsgCannotVerify)
+	case s.domains.isLocal(address):
+		s.sendResponse(writer, CodeOK, StatusRecipientOK, "<"+address+">")
+	default:
+		s.sendResponse(writer, CodeUserNotLocal, StatusBadMailbox, MsgDomainNotLocal)
 	}
 }
 
 func (s *SMTPServer) handleExpn(_cmd string, writer *bufio.Writer) {
-	s.sendResponse(writer, CodeUserNotLocal, MsgUserNotLocal)
+	s.sendResponse(writer, CodeUserNotLocal, StatusNotCapable, MsgUserNotLocal)
 }
 
 func (s *SMTPServer) handleHelp(writer *bufio.Writer) {
-	s.sendResponse(writer, CodeOK, MsgHelpMessage)
+	s.sendResponse(writer, CodeOK, StatusOK, MsgHelpMessage)
 }
 
-func (s *SMTPServer) handleStartTLS(writer *bufio.Writer, conn net.Conn, session *SMTPSession) int {
+func (s *SMTPServer) handleStartTLS(reader *bufio.Reader, writer *bufio.Writer, conn net.Conn, session *SMTPSession) int {
 	if session.isTLS {
-		s.sendResponse(writer, CodeCommandNotImplemented, "Already using TLS")
+		s.sendResponse(writer, CodeCommandNotImplemented, StatusInvalidCommand, "Already using TLS")
 		return 1
 	}
 
 	if s.tlsConfig == nil {
-		s.sendResponse(writer, CodeCommandNotImplemented, "TLS not available")
+		s.sendResponse(writer, CodeCommandNotImplemented, StatusInvalidCommand, "TLS not available")
 		return 1
 	}
 
-	s.sendResponse(writer, CodeStartTLS, MsgStartTLS)
+	s.sendResponse(writer, CodeStartTLS, StatusOK, MsgStartTLS)
+	writer.Flush()
+
+	// Plaintext pipelined after STARTTLS must not be treated as commands
+	// sent over the encrypted channel
+	if buffered := reader.Buffered(); buffered > 0 {
+		slog.Warn("Discarding plaintext pipelined after STARTTLS", "bytes", buffered)
+		reader.Discard(buffered)
+	}
 
 	tlsConn := tls.Server(conn, s.tlsConfig)
 	err := tlsConn.Handshake()
@@ -428,11 +1025,15 @@ func (s *SMTPServer) handleStartTLS(writer *bufio.Writer, conn net.Conn, session
 		return 0
 	}
 
-	session.isTLS = true
+	// The client must greet again after the upgrade (RFC 3207 4.2)
+	session.recordTLS(tlsConn.ConnectionState())
+	session.heloName = ""
+	session.authUser = ""
+	session.resetTransaction()
 	slog.Info("TLS connection established", "client", conn.RemoteAddr().String())
 
 	// Continue with TLS connection
-	s.handleConnectionWithoutClose(tlsConn, session)
+	s.handleConnectionWithoutClose(tlsConn, session, false)
 	return -1
 }
 
@@ -461,32 +1062,17 @@ func (s *SMTPServer) extractEmailFromCommand(cmd, prefix string) string {
 	return ""
 }
 
-func (s *SMTPServer) storeEmailInRedis(parsedEmail *email.Email, session *SMTPSession) error {
-	emailData := map[string]interface{}{
-		"id":          parsedEmail.ID,
-		"from":        session.from,
-		"recipients":  session.recipients,
-		"subject":     parsedEmail.Subject,
-		"body":        parsedEmail.Body,
-		"headers":     parsedEmail.Headers,
-		"attachments": parsedEmail.Attachments,
-		"received_at": parsedEmail.ReceivedAt,
-		"size":        parsedEmail.Size,
-		"is_utf8":     parsedEmail.IsUTF8,
-	}
+func (s *SMTPServer) storeEmail(parsedEmail *email.Email, raw, trace []byte, envelope *storage.Envelope) error {
+	msg := storage.NewMessage(parsedEmail, envelope.MailFrom, envelope.RcptTo)
+	msg.Raw = raw
+	msg.Trace = string(trace)
+	msg.Size = int64(len(raw))
+	msg.Envelope = envelope
 
-	if err := s.redisClient.StoreEmailWithRecipients(parsedEmail.ID, emailData, session.recipients); err != nil {
+	if err := s.store.Save(msg); err != nil {
 		return err
 	}
 
-	if err := s.redisClient.QueueEmail("inbound", emailData); err != nil {
-		slog.Warn("Failed to queue email for processing", "error", err, "id", parsedEmail.ID)
-	}
-
-	if err := s.redisClient.IncrementEmailCount("received"); err != nil {
-		slog.Warn("Failed to update email statistics", "error", err)
-	}
-
-	slog.Info("Email stored in Redis with recipient indexing", "id", parsedEmail.ID, "recipients", session.recipients)
+	slog.Info("Email stored with recipient indexing", "id", parsedEmail.ID, "recipients", envelope.RcptTo, "session", envelope.SessionID)
 	return nil
 }
@@ -0,0 +1,246 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"nullmail/internal/storage"
+)
+
+// startTestServer serves a server backed by a memory store on an
+// ephemeral port
+func startTestServer(t *testing.T, config Config) (string, *storage.MemoryStore) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+
+	store := storage.NewMemoryStore(storage.DefaultMaxMessages)
+	server := NewSMTPServer(store, config)
+	go server.Serve(listener)
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+	return listener.Addr().String(), store
+}
+
+// testClient speaks raw SMTP so that out-of-order commands can be sent
+type testClient struct {
+	t    *testing.T
+	conn *textproto.Conn
+}
+
+func dialTestServer(t *testing.T, addr string) *testClient {
+	t.Helper()
+
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	client := &testClient{t: t, conn: conn}
+	client.expect(220)
+	return client
+}
+
+// expect reads one reply and fails the test unless it has the given code
+func (c *testClient) expect(code int) string {
+	c.t.Helper()
+
+	got, message, err := c.conn.ReadResponse(0)
+	if err != nil && got == 0 {
+		c.t.Fatalf("reading reply: %v", err)
+	}
+	if got != code {
+		c.t.Fatalf("reply %d %q, want %d", got, message, code)
+	}
+	return message
+}
+
+// cmd sends a command line and checks the reply code
+func (c *testClient) cmd(line string, code int) string {
+	c.t.Helper()
+
+	if err := c.conn.PrintfLine("%s", line); err != nil {
+		c.t.Fatalf("sending %q: %v", line, err)
+	}
+	return c.expect(code)
+}
+
+// write sends raw bytes, such as a BDAT chunk, without a line ending
+func (c *testClient) write(data string) {
+	c.t.Helper()
+
+	if _, err := c.conn.W.WriteString(data); err != nil {
+		c.t.Fatalf("writing: %v", err)
+	}
+	if err := c.conn.W.Flush(); err != nil {
+		c.t.Fatalf("writing: %v", err)
+	}
+}
+
+// inbox returns the recipients of every message stored for an address
+func inbox(t *testing.T, store *storage.MemoryStore, address string) [][]string {
+	t.Helper()
+
+	ids, err := store.ListByRecipient(address)
+	if err != nil {
+		t.Fatalf("ListByRecipient(%s): %v", address, err)
+	}
+
+	var recipients [][]string
+	for _, id := range ids {
+		msg, err := store.Get(id)
+		if err != nil {
+			t.Fatalf("Get(%s): %v", id, err)
+		}
+		recipients = append(recipients, msg.Recipients)
+	}
+	return recipients
+}
+
+func TestCommandSequence(t *testing.T) {
+	type step struct {
+		line string
+		code int
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "MAIL before EHLO",
+			steps: []step{
+				{"MAIL FROM:<a@example.com>", 503},
+			},
+		},
+		{
+			name: "RCPT before MAIL",
+			steps: []step{
+				{"EHLO client.example.com", 250},
+				{"RCPT TO:<b@example.com>", 503},
+			},
+		},
+		{
+			name: "DATA before MAIL",
+			steps: []step{
+				{"EHLO client.example.com", 250},
+				{"DATA", 503},
+			},
+		},
+		{
+			name: "DATA before RCPT",
+			steps: []step{
+				{"EHLO client.example.com", 250},
+				{"MAIL FROM:<a@example.com>", 250},
+				{"DATA", 503},
+			},
+		},
+		{
+			name: "nested MAIL",
+			steps: []step{
+				{"EHLO client.example.com", 250},
+				{"MAIL FROM:<a@example.com>", 250},
+				{"MAIL FROM:<c@example.com>", 503},
+			},
+		},
+		{
+			name: "RSET clears the transaction",
+			steps: []step{
+				{"EHLO client.example.com", 250},
+				{"MAIL FROM:<a@example.com>", 250},
+				{"RCPT TO:<b@example.com>", 250},
+				{"RSET", 250},
+				{"DATA", 503},
+				{"RCPT TO:<b@example.com>", 503},
+				{"MAIL FROM:<a@example.com>", 250},
+			},
+		},
+		{
+			name: "EHLO clears the transaction",
+			steps: []step{
+				{"EHLO client.example.com", 250},
+				{"MAIL FROM:<a@example.com>", 250},
+				{"RCPT TO:<b@example.com>", 250},
+				{"EHLO client.example.com", 250},
+				{"DATA", 503},
+			},
+		},
+		{
+			name: "HELO allows a transaction",
+			steps: []step{
+				{"HELO client.example.com", 250},
+				{"MAIL FROM:<a@example.com>", 250},
+				{"RCPT TO:<b@example.com>", 250},
+				{"DATA", 354},
+			},
+		},
+		{
+			name: "BINARYMIME requires BDAT",
+			steps: []step{
+				{"EHLO client.example.com", 250},
+				{"MAIL FROM:<a@example.com> BODY=BINARYMIME", 250},
+				{"RCPT TO:<b@example.com>", 250},
+				{"DATA", 503},
+			},
+		},
+	}
+
+	addr, _ := startTestServer(t, Config{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dialTestServer(t, addr)
+			for _, step := range tt.steps {
+				client.cmd(step.line, step.code)
+			}
+		})
+	}
+}
+
+func TestEnvelopeResetBetweenMessages(t *testing.T) {
+	addr, store := startTestServer(t, Config{})
+	client := dialTestServer(t, addr)
+
+	client.cmd("EHLO client.example.com", 250)
+
+	client.cmd("MAIL FROM:<a@example.com>", 250)
+	client.cmd("RCPT TO:<first@example.com>", 250)
+	client.cmd("DATA", 354)
+	client.cmd("Subject: one\r\n\r\nfirst\r\n.", 250)
+
+	// Recipients of an abandoned transaction must not leak into the next
+	client.cmd("MAIL FROM:<a@example.com>", 250)
+	client.cmd("RCPT TO:<abandoned@example.com>", 250)
+	client.cmd("RSET", 250)
+
+	client.cmd("MAIL FROM:<a@example.com>", 250)
+	client.cmd("RCPT TO:<second@example.com>", 250)
+	client.cmd("DATA", 354)
+	client.cmd("Subject: two\r\n\r\nsecond\r\n.", 250)
+	client.cmd("QUIT", 221)
+
+	for address, want := range map[string]string{
+		"first@example.com":     "first@example.com",
+		"second@example.com":    "second@example.com",
+		"abandoned@example.com": "",
+	} {
+		var got []string
+		for _, recipients := range inbox(t, store, address) {
+			got = append(got, strings.Join(recipients, ","))
+		}
+		if strings.Join(got, ";") != want {
+			t.Errorf("messages for %s have recipients %q, want %q", address, got, want)
+		}
+	}
+}
@@ -1,98 +1,273 @@
 package smtp
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
 	"log/slog"
 	"math/big"
 	"net"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
-// generateSelfSignedCert creates a self-signed certificate for development
-func generateSelfSignedCert() (tls.Certificate, error) {
-	// Generate private key
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+// Development CA file names inside TLSConfig.DevCADir
+const (
+	devCACertFile = "nullmail-ca.crt"
+	devCAKeyFile  = "nullmail-ca.key"
+)
+
+// loadTLSConfig builds the server TLS configuration. Configured certificate
+// files are reloaded when they change, and an error is returned if they
+// cannot be loaded. Without them a development certificate for hosts is
+// issued from a self-signed CA; if that fails, TLS is disabled and nil is
+// returned.
+func loadTLSConfig(config TLSConfig, hosts []string) (*tls.Config, error) {
+	if config.CertFile != "" || config.KeyFile != "" {
+		reloader, err := newCertReloader(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate %s: %w", config.CertFile, err)
+		}
+		slog.Info("Loaded TLS certificate", "cert", config.CertFile, "key", config.KeyFile)
+
+		return &tls.Config{
+			GetCertificate: reloader.GetCertificate,
+		}, nil
+	}
+
+	cert, err := devCertificate(config.DevCADir, hosts)
+	if err != nil {
+		slog.Error("Failed to generate TLS certificate", "error", err)
+		return nil, nil
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
+// certReloader serves a certificate from disk and reloads it when the
+// certificate or key file changes, so certificates can be rotated without
+// a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both a certificate and a key file are required")
+	}
+
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.changed() {
+		if err := r.reload(); err != nil {
+			// Keep serving the previous certificate, e.g. while only one
+			// of the two files has been replaced
+			slog.Warn("Failed to reload TLS certificate, keeping the current one", "cert", r.certFile, "error", err)
+		} else {
+			slog.Info("Reloaded TLS certificate", "cert", r.certFile)
+		}
+	}
+	return r.cert, nil
+}
+
+// changed reports whether either file was modified since the last load
+func (r *certReloader) changed() bool {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return false
+	}
+	return !certInfo.ModTime().Equal(r.certMod) || !keyInfo.ModTime().Equal(r.keyMod)
+}
+
+// reload reads both files. The modification times are recorded even when
+// loading fails so that a broken pair is retried only after another change.
+func (r *certReloader) reload() error {
+	if info, err := os.Stat(r.certFile); err == nil {
+		r.certMod = info.ModTime()
+	}
+	if info, err := os.Stat(r.keyFile); err == nil {
+		r.keyMod = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	return nil
+}
+
+// devCertificate issues a server certificate for development, valid for
+// hosts, from the CA persisted in dir, creating the CA on first use. Clients can trust the CA
+// once instead of accepting a new self-signed certificate on every start.
+// With an empty dir the CA only lives for this process.
+func devCertificate(dir string, hosts []string) (tls.Certificate, error) {
+	caCert, caKey, err := loadOrCreateDevCA(dir)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := randomSerial()
 	if err != nil {
 		return tls.Certificate{}, err
 	}
 
-	// Create certificate template
 	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
+		SerialNumber: serial,
 		Subject: pkix.Name{
-			Organization:  []string{"Nullmail Development"},
-			Country:       []string{"US"},
-			Province:      []string{""},
-			Locality:      []string{"San Francisco"},
-			StreetAddress: []string{""},
-			PostalCode:    []string{""},
+			Organization: []string{"Nullmail Development"},
+			CommonName:   hosts[0],
 		},
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().Add(365 * 24 * time.Hour), // Valid for 1 year
-		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
-		DNSNames:     []string{"localhost", "temp-smtp.local", "nullmail.local", "smtp.nullmail.nitin.sh", "nullmail.nitin.sh"},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(365 * 24 * time.Hour), // Valid for 1 year
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		DNSNames:    hosts,
 	}
 
-	// Create certificate
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, caCert, &key.PublicKey, caKey)
 	if err != nil {
 		return tls.Certificate{}, err
 	}
 
-	// Convert to PEM format
-	certPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: certDER,
-	})
+	slog.Info("Issued development TLS certificate", "ca", caCert.Subject.CommonName, "hosts", hosts)
+	return tls.Certificate{
+		Certificate: [][]byte{certDER, caCert.Raw},
+		PrivateKey:  key,
+	}, nil
+}
 
-	keyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
-	})
+// loadOrCreateDevCA reads the development CA from dir, generating and
+// saving a new one if it does not exist yet
+func loadOrCreateDevCA(dir string) (*x509.Certificate, crypto.Signer, error) {
+	if dir != "" {
+		certPath := filepath.Join(dir, devCACertFile)
+		keyPath := filepath.Join(dir, devCAKeyFile)
 
-	// Create TLS certificate
-	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+		pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err == nil {
+			caCert, err := x509.ParseCertificate(pair.Certificate[0])
+			if err != nil {
+				return nil, nil, fmt.Errorf("parse development CA %s: %w", certPath, err)
+			}
+			signer, ok := pair.PrivateKey.(crypto.Signer)
+			if !ok {
+				return nil, nil, fmt.Errorf("development CA key %s cannot sign", keyPath)
+			}
+			return caCert, signer, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, fmt.Errorf("load development CA: %w", err)
+		}
+	}
+
+	caCert, caKey, certPEM, keyPEM, err := generateDevCA()
 	if err != nil {
-		return tls.Certificate{}, err
+		return nil, nil, err
+	}
+
+	if dir == "" {
+		slog.Warn("No development CA directory configured, using a temporary CA")
+		return caCert, caKey, nil
 	}
 
-	slog.Info("Generated self-signed TLS certificate for development")
-	return tlsCert, nil
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, nil, fmt.Errorf("create development CA directory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, devCAKeyFile), keyPEM, 0o600); err != nil {
+		return nil, nil, fmt.Errorf("save development CA key: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, devCACertFile), certPEM, 0o644); err != nil {
+		return nil, nil, fmt.Errorf("save development CA: %w", err)
+	}
+
+	slog.Info("Created development CA, trust it to verify nullmail certificates", "path", filepath.Join(dir, devCACertFile))
+	return caCert, caKey, nil
 }
 
-// loadOrGenerateTLSConfig loads existing certs or generates new ones
-func loadOrGenerateTLSConfig() *tls.Config {
-	// Try to load existing certificate files
-	if _, err := os.Stat("server.crt"); err == nil {
-		if _, err := os.Stat("server.key"); err == nil {
-			cert, err := tls.LoadX509KeyPair("server.crt", "server.key")
-			if err == nil {
-				slog.Info("Loaded existing TLS certificate")
-				return &tls.Config{
-					Certificates: []tls.Certificate{cert},
-					ServerName:   "temp-smtp.local",
-				}
-			}
-		}
+// generateDevCA creates a self-signed CA and returns it parsed and PEM encoded
+func generateDevCA() (*x509.Certificate, crypto.Signer, []byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, nil, err
 	}
 
-	// Generate self-signed certificate for development
-	cert, err := generateSelfSignedCert()
+	serial, err := randomSerial()
 	if err != nil {
-		slog.Error("Failed to generate TLS certificate", "error", err)
-		return nil
+		return nil, nil, nil, nil, err
 	}
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		ServerName:   "temp-smtp.local",
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"Nullmail Development"},
+			CommonName:   "Nullmail Development CA",
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	caCert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, nil, nil, err
 	}
-}
\ No newline at end of file
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return caCert, key, certPEM, keyPEM, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
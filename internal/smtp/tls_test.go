@@ -0,0 +1,59 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"testing"
+
+	"nullmail/internal/storage"
+)
+
+func TestRequireTLSGatesAuth(t *testing.T) {
+	addr, _ := startTestServer(t, Config{TLS: TLSConfig{Require: true}})
+	credentials := "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00user\x00secret"))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	client := &testClient{t: t, conn: textproto.NewConn(conn)}
+	client.expect(220)
+	client.cmd("EHLO client.example.com", 250)
+	client.cmd(credentials, 530)
+	client.cmd("MAIL FROM:<a@example.com>", 530)
+
+	client.cmd("STARTTLS", 220)
+	client.conn = textproto.NewConn(tls.Client(conn, &tls.Config{InsecureSkipVerify: true}))
+	client.cmd("EHLO client.example.com", 250)
+	client.cmd(credentials, 235)
+	client.cmd("MAIL FROM:<a@example.com>", 250)
+}
+
+func TestConfiguredCertificateMustLoad(t *testing.T) {
+	dir := t.TempDir()
+	server := NewSMTPServer(storage.NewMemoryStore(0), Config{
+		TLS: TLSConfig{
+			CertFile: filepath.Join(dir, "missing.crt"),
+			KeyFile:  filepath.Join(dir, "missing.key"),
+		},
+	})
+	if server.Err() == nil {
+		t.Fatal("Err = nil for a certificate that does not exist")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	if err := server.Serve(listener); err == nil {
+		t.Fatal("Serve = nil, want the certificate error")
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Error("listener still accepts connections")
+	}
+}
@@ -0,0 +1,139 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"nullmail/internal/storage"
+)
+
+const (
+	// maxTranscriptEntries bounds the lines recorded per session
+	maxTranscriptEntries = 1000
+
+	// maxContentPreview is how much message content a transcript keeps
+	maxContentPreview = 256
+
+	// maskedCredentials replaces AUTH data in transcripts
+	maskedCredentials = "****"
+)
+
+// transcript records the lines exchanged in a session. Client lines are
+// added by the command loop; server lines are captured from the bytes
+// written to the connection, so every reply is recorded when it is sent.
+// It is only used by the session's goroutine.
+type transcript struct {
+	record   storage.Transcript
+	pending  []byte // server output not yet terminated by a newline
+	commands int    // client lines recorded
+}
+
+func newTranscript(session *SMTPSession) *transcript {
+	return &transcript{
+		record: storage.Transcript{
+			SessionID: session.id,
+			ClientIP:  session.clientIP,
+			Listener:  session.listener,
+			StartedAt: time.Now(),
+		},
+	}
+}
+
+func (t *transcript) add(direction, line string) {
+	if len(t.record.Entries) >= maxTranscriptEntries {
+		t.record.Truncated = true
+		return
+	}
+	t.record.Entries = append(t.record.Entries, storage.TranscriptEntry{
+		Time:      time.Now(),
+		Direction: direction,
+		Line:      line,
+	})
+}
+
+// client records a line sent by the client
+func (t *transcript) client(line string) {
+	t.commands++
+	t.add(storage.DirectionClient, line)
+}
+
+// command records a command line, masking AUTH initial responses
+func (t *transcript) command(line string) {
+	fields := strings.Fields(line)
+	if len(fields) > 2 && strings.EqualFold(fields[0], "AUTH") {
+		line = fields[0] + " " + fields[1] + " " + maskedCredentials
+	}
+	t.client(line)
+}
+
+// content records message content sent after DATA or BDAT, truncated to a
+// short preview
+func (t *transcript) content(data []byte) {
+	preview := data
+	if len(preview) > maxContentPreview {
+		preview = preview[:maxContentPreview]
+		// Do not cut a UTF-8 sequence in half
+		for len(preview) > 0 && !utf8.Valid(preview) {
+			preview = preview[:len(preview)-1]
+		}
+	}
+
+	line := fmt.Sprintf("[%d octets of message content]", len(data))
+	if len(preview) > 0 {
+		line += " " + strings.ReplaceAll(string(preview), "\r\n", "\\r\\n")
+	}
+	if len(preview) < len(data) {
+		line += "..."
+	}
+	t.client(line)
+}
+
+// server records complete lines written by the server
+func (t *transcript) server(p []byte) {
+	t.pending = append(t.pending, p...)
+	for {
+		end := bytes.IndexByte(t.pending, '\n')
+		if end < 0 {
+			return
+		}
+		t.add(storage.DirectionServer, strings.TrimRight(string(t.pending[:end]), "\r"))
+		t.pending = t.pending[end+1:]
+	}
+}
+
+// linkMessage notes a message delivered in the session
+func (t *transcript) linkMessage(id string) {
+	t.record.MessageIDs = append(t.record.MessageIDs, id)
+}
+
+// snapshot returns a copy of the transcript that is safe to store while the
+// session continues
+func (t *transcript) snapshot(ended bool) *storage.Transcript {
+	record := t.record
+	record.Entries = append([]storage.TranscriptEntry(nil), t.record.Entries...)
+	record.MessageIDs = append([]string{}, t.record.MessageIDs...)
+	if ended {
+		now := time.Now()
+		record.EndedAt = &now
+	}
+	return &record
+}
+
+// writer wraps w so that everything written to it is recorded
+func (t *transcript) writer(w io.Writer) io.Writer {
+	return &transcriptWriter{w: w, t: t}
+}
+
+type transcriptWriter struct {
+	w io.Writer
+	t *transcript
+}
+
+func (w *transcriptWriter) Write(p []byte) (int, error) {
+	w.t.server(p)
+	return w.w.Write(p)
+}
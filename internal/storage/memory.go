@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"nullmail/internal/email"
+)
+
+// DefaultMaxMessages caps how many messages a MemoryStore holds
+const DefaultMaxMessages = 1000
+
+type memoryEntry struct {
+	msg       *Message
+	expiresAt time.Time
+}
+
+type transcriptEntry struct {
+	transcript *Transcript
+	expiresAt  time.Time
+}
+
+// MemoryStore keeps messages in process memory. It is meant for tests and
+// local runs where Redis is not available.
+type MemoryStore struct {
+	mu          sync.RWMutex
+	messages    map[string]*memoryEntry
+	order       []string            // message IDs, oldest first
+	recipients  map[string][]string // recipient -> message IDs, oldest first
+	transcripts map[string]*transcriptEntry
+	sessions    []string // transcript session IDs, oldest first
+	ttl         time.Duration
+	maxMessages int
+}
+
+// NewMemoryStore creates an in-memory store holding at most maxMessages
+// messages, and as many session transcripts. When a cap is reached the
+// oldest entry is evicted.
+func NewMemoryStore(maxMessages int) *MemoryStore {
+	if maxMessages <= 0 {
+		maxMessages = DefaultMaxMessages
+	}
+
+	return &MemoryStore{
+		messages:    make(map[string]*memoryEntry),
+		recipients:  make(map[string][]string),
+		transcripts: make(map[string]*transcriptEntry),
+		ttl:         DefaultTTL,
+		maxMessages: maxMessages,
+	}
+}
+
+func (s *MemoryStore) Save(msg *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.purgeExpired(now)
+
+	if _, exists := s.messages[msg.ID]; exists {
+		s.remove(msg.ID)
+	}
+
+	for len(s.order) >= s.maxMessages {
+		s.remove(s.order[0])
+	}
+
+	s.messages[msg.ID] = &memoryEntry{msg: msg, expiresAt: now.Add(s.ttl)}
+	s.order = append(s.order, msg.ID)
+	for _, recipient := range msg.Recipients {
+		key := inboxKey(recipient)
+		s.recipients[key] = append(s.recipients[key], msg.ID)
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) Get(id string) (*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.messages[id]
+	if !ok || !time.Now().Before(entry.expiresAt) {
+		return nil, ErrNotFound
+	}
+	return entry.msg, nil
+}
+
+func (s *MemoryStore) GetRaw(id string) ([]byte, error) {
+	msg, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Raw == nil {
+		return nil, ErrNotFound
+	}
+	return msg.Raw, nil
+}
+
+func (s *MemoryStore) GetAttachment(id string, index int) (*email.Attachment, error) {
+	msg, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return msg.attachmentAt(index)
+}
+
+func (s *MemoryStore) ListByRecipient(recipient string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	ids := s.recipients[inboxKey(recipient)]
+	result := make([]string, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		if entry, ok := s.messages[ids[i]]; ok && now.Before(entry.expiresAt) {
+			result = append(result, ids[i])
+		}
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.messages[id]; !ok {
+		return ErrNotFound
+	}
+	s.remove(id)
+	return nil
+}
+
+func (s *MemoryStore) DeleteInbox(recipient string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// remove shrinks the index slice in place, so iterate over a copy
+	recipient = inboxKey(recipient)
+	ids := append([]string(nil), s.recipients[recipient]...)
+	for _, id := range ids {
+		entry, ok := s.messages[id]
+		if ok && len(entry.msg.Recipients) <= 1 {
+			s.remove(id)
+		}
+	}
+	delete(s.recipients, recipient)
+	return nil
+}
+
+func (s *MemoryStore) Expire(id string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.messages[id]
+	if !ok || !time.Now().Before(entry.expiresAt) {
+		return ErrNotFound
+	}
+	entry.expiresAt = time.Now().Add(ttl)
+	return nil
+}
+
+func (s *MemoryStore) SaveTranscript(transcript *Transcript) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, entry := range s.transcripts {
+		if !now.Before(entry.expiresAt) {
+			s.removeTranscript(id)
+		}
+	}
+
+	if _, exists := s.transcripts[transcript.SessionID]; exists {
+		s.removeTranscript(transcript.SessionID)
+	}
+
+	for len(s.sessions) >= s.maxMessages {
+		s.removeTranscript(s.sessions[0])
+	}
+
+	s.transcripts[transcript.SessionID] = &transcriptEntry{transcript: transcript, expiresAt: now.Add(s.ttl)}
+	s.sessions = append(s.sessions, transcript.SessionID)
+	return nil
+}
+
+func (s *MemoryStore) GetTranscript(sessionID string) (*Transcript, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.transcripts[sessionID]
+	if !ok || !time.Now().Before(entry.expiresAt) {
+		return nil, ErrNotFound
+	}
+	return entry.transcript, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// purgeExpired drops every message whose TTL has elapsed. Callers must hold the write lock.
+func (s *MemoryStore) purgeExpired(now time.Time) {
+	for id, entry := range s.messages {
+		if !now.Before(entry.expiresAt) {
+			s.remove(id)
+		}
+	}
+}
+
+// remove deletes a message and its index entries. Callers must hold the write lock.
+func (s *MemoryStore) remove(id string) {
+	entry, ok := s.messages[id]
+	if !ok {
+		return
+	}
+	delete(s.messages, id)
+	s.order = removeID(s.order, id)
+
+	for _, recipient := range entry.msg.Recipients {
+		key := inboxKey(recipient)
+		ids := removeID(s.recipients[key], id)
+		if len(ids) == 0 {
+			delete(s.recipients, key)
+		} else {
+			s.recipients[key] = ids
+		}
+	}
+}
+
+// removeTranscript deletes a transcript. Callers must hold the write lock.
+func (s *MemoryStore) removeTranscript(sessionID string) {
+	delete(s.transcripts, sessionID)
+	s.sessions = removeID(s.sessions, sessionID)
+}
+
+func removeID(ids []string, id string) []string {
+	for i, existing := range ids {
+		if existing == id {
+			return append(ids[:i], ids[i+1:]...)
+		}
+	}
+	return ids
+}
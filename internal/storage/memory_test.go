@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMemoryStoreDeleteInbox(t *testing.T) {
+	store := NewMemoryStore(DefaultMaxMessages)
+
+	for i := 0; i < 5; i++ {
+		msg := &Message{ID: fmt.Sprintf("only-%d", i), Recipients: []string{"r@example.com"}}
+		if err := store.Save(msg); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	shared := &Message{ID: "shared", Recipients: []string{"r@example.com", "other@example.com"}}
+	if err := store.Save(shared); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	if err := store.DeleteInbox("r@example.com"); err != nil {
+		t.Fatalf("DeleteInbox: %v", err)
+	}
+
+	if ids, _ := store.ListByRecipient("r@example.com"); len(ids) != 0 {
+		t.Errorf("inbox still lists %v", ids)
+	}
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprintf("only-%d", i)
+		if _, err := store.Get(id); err != ErrNotFound {
+			t.Errorf("Get(%s) = %v, want ErrNotFound", id, err)
+		}
+	}
+
+	// A message with other recipients stays in their inboxes
+	if ids, _ := store.ListByRecipient("other@example.com"); len(ids) != 1 || ids[0] != "shared" {
+		t.Errorf("other inbox = %v, want [shared]", ids)
+	}
+}
+
+func TestMemoryStoreRecipientCase(t *testing.T) {
+	store := NewMemoryStore(DefaultMaxMessages)
+
+	msg := &Message{ID: "mixed", Recipients: []string{"Alice@Example.com"}}
+	if err := store.Save(msg); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	for _, address := range []string{"alice@example.com", "ALICE@EXAMPLE.COM", "Alice@Example.com"} {
+		if ids, _ := store.ListByRecipient(address); len(ids) != 1 {
+			t.Errorf("ListByRecipient(%s) = %v, want [mixed]", address, ids)
+		}
+	}
+
+	if err := store.DeleteInbox("alice@example.com"); err != nil {
+		t.Fatalf("DeleteInbox: %v", err)
+	}
+	if _, err := store.Get("mixed"); err != ErrNotFound {
+		t.Errorf("Get after DeleteInbox = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"nullmail/internal/email"
+	"nullmail/internal/redis"
+)
+
+// RedisStore keeps messages in Redis using the key layout read by the web client
+type RedisStore struct {
+	client *redis.Client
+}
+
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+// Client returns the underlying Redis client, for features that share the
+// connection such as rate limiting
+func (s *RedisStore) Client() *redis.Client {
+	return s.client
+}
+
+// NewRedisStoreFromEnv connects using REDIS_URL and verifies the connection
+func NewRedisStoreFromEnv() (*RedisStore, error) {
+	client := redis.NewClientFromEnv()
+	if client == nil {
+		return nil, fmt.Errorf("invalid redis configuration")
+	}
+
+	if err := client.Ping(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return NewRedisStore(client), nil
+}
+
+func (s *RedisStore) Save(msg *Message) error {
+	// Raw and attachment content are excluded from the message JSON, so store
+	// them first under their own keys with the same TTL
+	if msg.Raw != nil {
+		if err := s.client.StoreRaw(msg.ID, msg.Raw, DefaultTTL); err != nil {
+			return err
+		}
+	}
+
+	for i, attachment := range msg.Attachments {
+		if err := s.client.StoreAttachment(msg.ID, i, attachment.Data, DefaultTTL); err != nil {
+			return err
+		}
+	}
+
+	keys := make([]string, len(msg.Recipients))
+	for i, recipient := range msg.Recipients {
+		keys[i] = inboxKey(recipient)
+	}
+	if err := s.client.StoreEmailWithRecipients(msg.ID, msg, keys); err != nil {
+		return err
+	}
+
+	if err := s.client.QueueEmail("inbound", msg); err != nil {
+		slog.Warn("Failed to queue email for processing", "error", err, "id", msg.ID)
+	}
+
+	if err := s.client.IncrementEmailCount("received"); err != nil {
+		slog.Warn("Failed to update email statistics", "error", err)
+	}
+
+	return nil
+}
+
+func (s *RedisStore) Get(id string) (*Message, error) {
+	data, err := s.client.GetEmail(id)
+	if errors.Is(err, redis.ErrEmailNotFound) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var msg Message
+	if err := json.Unmarshal([]byte(data), &msg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal email %s: %w", id, err)
+	}
+	return &msg, nil
+}
+
+func (s *RedisStore) GetRaw(id string) ([]byte, error) {
+	data, err := s.client.GetRaw(id)
+	if errors.Is(err, redis.ErrEmailNotFound) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (s *RedisStore) GetAttachment(id string, index int) (*email.Attachment, error) {
+	msg, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	attachment, err := msg.attachmentAt(index)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := s.client.GetAttachment(id, index)
+	if errors.Is(err, redis.ErrEmailNotFound) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	attachment.Data = data
+	return attachment, nil
+}
+
+func (s *RedisStore) ListByRecipient(recipient string) ([]string, error) {
+	return s.client.GetEmailsForRecipient(inboxKey(recipient))
+}
+
+func (s *RedisStore) Delete(id string) error {
+	msg, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+
+	for _, recipient := range msg.Recipients {
+		if err := s.client.RemoveEmailForRecipient(inboxKey(recipient), id); err != nil {
+			slog.Warn("Failed to remove email from recipient index", "recipient", recipient, "id", id, "error", err)
+		}
+	}
+
+	if err := s.client.DeleteAttachments(id, len(msg.Attachments)); err != nil {
+		slog.Warn("Failed to delete attachments", "id", id, "error", err)
+	}
+
+	if err := s.client.DeleteRaw(id); err != nil {
+		slog.Warn("Failed to delete raw message", "id", id, "error", err)
+	}
+
+	return s.client.DeleteEmail(id)
+}
+
+func (s *RedisStore) DeleteInbox(recipient string) error {
+	recipient = inboxKey(recipient)
+	ids, err := s.client.GetEmailsForRecipient(recipient)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		msg, err := s.Get(id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if len(msg.Recipients) <= 1 {
+			if err := s.client.DeleteAttachments(id, len(msg.Attachments)); err != nil {
+				slog.Warn("Failed to delete attachments", "id", id, "error", err)
+			}
+			if err := s.client.DeleteRaw(id); err != nil {
+				slog.Warn("Failed to delete raw message", "id", id, "error", err)
+			}
+			if err := s.client.DeleteEmail(id); err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.client.DeleteRecipientIndex(recipient)
+}
+
+func (s *RedisStore) Expire(id string, ttl time.Duration) error {
+	msg, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+
+	if err := s.client.ExpireAttachments(id, len(msg.Attachments), ttl); err != nil {
+		return err
+	}
+
+	if err := s.client.ExpireRaw(id, ttl); err != nil {
+		return err
+	}
+
+	err = s.client.ExpireEmail(id, ttl)
+	if errors.Is(err, redis.ErrEmailNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *RedisStore) SaveTranscript(transcript *Transcript) error {
+	return s.client.StoreTranscript(transcript.SessionID, transcript, DefaultTTL)
+}
+
+func (s *RedisStore) GetTranscript(sessionID string) (*Transcript, error) {
+	data, err := s.client.GetTranscript(sessionID)
+	if errors.Is(err, redis.ErrEmailNotFound) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var transcript Transcript
+	if err := json.Unmarshal(data, &transcript); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal transcript %s: %w", sessionID, err)
+	}
+	return &transcript, nil
+}
+
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
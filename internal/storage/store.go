@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"nullmail/internal/email"
+)
+
+// DefaultTTL is how long a stored message is kept before it expires
+const DefaultTTL = 24 * time.Hour
+
+// ErrNotFound is returned when a message does not exist or has expired
+var ErrNotFound = errors.New("message not found")
+
+// Message is a received email together with its SMTP envelope
+type Message struct {
+	ID          string             `json:"id"`
+	From        string             `json:"from"`
+	Recipients  []string           `json:"recipients"`
+	Subject     string             `json:"subject"`
+	Body        email.EmailBody    `json:"body"`
+	Headers     map[string]string  `json:"headers"`
+	Attachments []email.Attachment `json:"attachments,omitempty"`
+	Parts       *email.MIMEPart    `json:"parts,omitempty"`
+	ReceivedAt  time.Time          `json:"received_at"`
+	Size        int64              `json:"size"`
+	IsUTF8      bool               `json:"is_utf8"`
+	Envelope    *Envelope          `json:"envelope,omitempty"`
+
+	// Trace holds the Return-Path and Received header fields added on
+	// delivery. They are kept out of Raw and only prepended when rendering.
+	Trace string `json:"trace,omitempty"`
+
+	// Raw is the DATA payload exactly as received, after dot-unstuffing.
+	// It is stored separately from the JSON document.
+	Raw []byte `json:"-"`
+}
+
+// Envelope is the SMTP session state a message was received with
+type Envelope struct {
+	SessionID string   `json:"session_id"`
+	ClientIP  string   `json:"client_ip"`
+	HeloName  string   `json:"helo_name"`
+	Protocol  string   `json:"protocol"` // RFC 3848 name such as "ESMTPSA"
+	Listener  string   `json:"listener"` // "smtp" or "smtps", the listener the message arrived on
+	TLS       *TLSInfo `json:"tls,omitempty"`
+	AuthUser  string   `json:"auth_user,omitempty"` // SMTP AUTH identity, if the client authenticated
+	MailFrom  string   `json:"mail_from"`
+	RcptTo    []string `json:"rcpt_to"`
+
+	// MAIL parameters
+	Size     int64  `json:"size,omitempty"` // SIZE= as declared by the client
+	Body     string `json:"body,omitempty"` // BODY=, e.g. "8BITMIME"
+	SMTPUTF8 bool   `json:"smtputf8"`
+}
+
+// TLSInfo describes the TLS state of a session
+type TLSInfo struct {
+	Version     string `json:"version"`      // e.g. "TLS 1.3"
+	CipherSuite string `json:"cipher_suite"` // IANA name, e.g. "TLS_AES_128_GCM_SHA256"
+}
+
+// NewMessage builds a storable message from a parsed email and its envelope
+func NewMessage(parsed *email.Email, from string, recipients []string) *Message {
+	return &Message{
+		ID:          parsed.ID,
+		From:        from,
+		Recipients:  recipients,
+		Subject:     parsed.Subject,
+		Body:        parsed.Body,
+		Headers:     parsed.Headers,
+		Attachments: parsed.Attachments,
+		Parts:       parsed.Parts,
+		ReceivedAt:  parsed.ReceivedAt,
+		Size:        parsed.Size,
+		IsUTF8:      parsed.IsUTF8,
+	}
+}
+
+// attachmentAt returns a copy of the attachment metadata at index, or ErrNotFound
+func (m *Message) attachmentAt(index int) (*email.Attachment, error) {
+	if index < 0 || index >= len(m.Attachments) {
+		return nil, ErrNotFound
+	}
+	attachment := m.Attachments[index]
+	return &attachment, nil
+}
+
+// inboxKey is the form a recipient address is indexed and looked up by.
+// Addresses are compared ignoring case, like event recipients, so mail sent
+// to <Alice@Example.com> lands in the inbox of alice@example.com.
+func inboxKey(recipient string) string {
+	return strings.ToLower(recipient)
+}
+
+// Store persists received messages and indexes them by recipient. Attachment
+// content is stored alongside each message and shares its lifetime.
+type Store interface {
+	// Save stores a message and adds it to the index of every recipient
+	Save(msg *Message) error
+
+	// Get returns a message by ID, or ErrNotFound
+	Get(id string) (*Message, error)
+
+	// GetRaw returns the original message bytes, or ErrNotFound if they were
+	// not kept
+	GetRaw(id string) ([]byte, error)
+
+	// GetAttachment returns an attachment of a message, including its content
+	GetAttachment(id string, index int) (*email.Attachment, error)
+
+	// ListByRecipient returns the IDs of messages for a recipient, newest
+	// first. Recipients are matched ignoring case.
+	ListByRecipient(recipient string) ([]string, error)
+
+	// Delete removes a message
+	Delete(id string) error
+
+	// DeleteInbox clears a recipient's index. Messages addressed only to that
+	// recipient are deleted; messages shared with other recipients are kept
+	// for them.
+	DeleteInbox(recipient string) error
+
+	// Expire changes the remaining lifetime of a message
+	Expire(id string, ttl time.Duration) error
+
+	// SaveTranscript stores or replaces the transcript of a session. It is
+	// kept for DefaultTTL independently of the messages it links to.
+	SaveTranscript(transcript *Transcript) error
+
+	// GetTranscript returns the transcript of a session, or ErrNotFound
+	GetTranscript(sessionID string) (*Transcript, error)
+
+	// Close releases any resources held by the store
+	Close() error
+}
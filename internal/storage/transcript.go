@@ -0,0 +1,29 @@
+package storage
+
+import "time"
+
+// Transcript directions
+const (
+	DirectionClient = "client"
+	DirectionServer = "server"
+)
+
+// Transcript is the conversation of one SMTP session. Message content and
+// credentials are not recorded in full.
+type Transcript struct {
+	SessionID  string            `json:"session_id"`
+	ClientIP   string            `json:"client_ip"`
+	Listener   string            `json:"listener"`
+	StartedAt  time.Time         `json:"started_at"`
+	EndedAt    *time.Time        `json:"ended_at,omitempty"` // nil while the session is open
+	MessageIDs []string          `json:"message_ids"`        // messages delivered in the session
+	Entries    []TranscriptEntry `json:"entries"`
+	Truncated  bool              `json:"truncated,omitempty"` // later entries were dropped
+}
+
+// TranscriptEntry is a single line sent by the client or the server
+type TranscriptEntry struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"` // DirectionClient or DirectionServer
+	Line      string    `json:"line"`
+}
@@ -0,0 +1,458 @@
+// Package nullmail runs an embeddable nullmail SMTP sink.
+//
+// A typical test starts a server on an ephemeral port, sends mail to it and
+// inspects the store:
+//
+//	srv := nullmail.New(nullmail.Options{Addr: "127.0.0.1:0"})
+//	go srv.ListenAndServe(ctx)
+//	addr := srv.Addr().String()
+//	defer srv.Shutdown(context.Background())
+//
+// The package never installs signal handlers; callers own the lifecycle.
+package nullmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"nullmail/internal/api"
+	"nullmail/internal/events"
+	"nullmail/internal/faults"
+	"nullmail/internal/ratelimit"
+	"nullmail/internal/smtp"
+	"nullmail/internal/storage"
+)
+
+// Store persists received messages and indexes them by recipient
+type Store = storage.Store
+
+// Message is a received email together with its SMTP envelope
+type Message = storage.Message
+
+// ErrNotFound is returned by a Store when a message does not exist or has expired
+var ErrNotFound = storage.ErrNotFound
+
+// NewMemoryStore returns an in-process store holding at most maxMessages messages
+func NewMemoryStore(maxMessages int) Store {
+	return storage.NewMemoryStore(maxMessages)
+}
+
+// NewRedisStoreFromEnv returns a Redis-backed store configured by REDIS_URL
+func NewRedisStoreFromEnv() (Store, error) {
+	store, err := storage.NewRedisStoreFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// RateLimit allows a number of events per period, with bursts up to that number
+type RateLimit = ratelimit.Limit
+
+// ParseRateLimit reads a limit such as "100/h", "10/m" or "5/30s"
+func ParseRateLimit(value string) (RateLimit, error) {
+	return ratelimit.ParseLimit(value)
+}
+
+// FaultRule makes matching RCPT or DATA commands fail on purpose
+type FaultRule = faults.Rule
+
+// FaultSet holds the fault rules of a running server
+type FaultSet = faults.Set
+
+// Fault rule stages
+const (
+	FaultStageRcpt = faults.StageRcpt
+	FaultStageData = faults.StageData
+)
+
+// Options configures a Server
+type Options struct {
+	// Addr is the SMTP listen address. Use "127.0.0.1:0" for an ephemeral port.
+	// Defaults to ":2525".
+	Addr string
+
+	// TLSAddr is the implicit TLS (SMTPS) listen address, conventionally
+	// ":465". It is served alongside Addr and disabled when empty.
+	TLSAddr string
+
+	// LocalDomains lists the recipient domains mail is accepted for;
+	// "*.example.com" matches every subdomain of example.com. RCPT to other
+	// domains gets 550. When empty, mail for every domain is accepted.
+	LocalDomains []string
+
+	// Hostname is announced in the SMTP greeting and EHLO reply. Defaults to
+	// the first entry of LocalDomains that is not a wildcard.
+	Hostname string
+
+	// Store persists received messages. Defaults to an in-memory store.
+	Store Store
+
+	// HTTPAddr is the listen address of the REST API and /health endpoint.
+	// The API is disabled when empty.
+	HTTPAddr string
+
+	// AuthUsers maps SMTP AUTH usernames to passwords. When empty, any
+	// credentials are accepted.
+	AuthUsers map[string]string
+
+	// AuthAcceptAny accepts any credentials even when AuthUsers is set. The
+	// username is still recorded on stored messages.
+	AuthAcceptAny bool
+
+	// TLSCertFile and TLSKeyFile are the PEM certificate and key served for
+	// STARTTLS and SMTPS. They are reloaded when either file changes.
+	// ListenAndServe returns an error if they cannot be loaded.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// TLSDevCADir persists the self-signed development CA that issues the
+	// certificate when TLSCertFile is not set. A temporary CA is used when
+	// empty.
+	TLSDevCADir string
+
+	// RequireTLS rejects MAIL and AUTH with 530 until the client has used STARTTLS
+	// or connected over SMTPS
+	RequireTLS bool
+
+	// CommandTimeout and DataTimeout bound how long a client may stay idle
+	// while the server waits for a command or for message content. They
+	// default to 5m and 3m.
+	CommandTimeout time.Duration
+	DataTimeout    time.Duration
+
+	// MaxSessions and MaxSessionsPerIP cap concurrent SMTP sessions overall
+	// and per client address; further connections get 421. They default to
+	// 1000 and 100, and negative values disable the cap.
+	MaxSessions      int
+	MaxSessionsPerIP int
+
+	// ConnectionRateLimit, SenderRateLimit and RecipientRateLimit throttle
+	// new sessions per client IP, messages per MAIL FROM address and
+	// messages per recipient. Clients over a limit get 450 or 452. The
+	// buckets are kept in Redis when Store is the Redis store, so replicas
+	// share them. Zero limits are disabled.
+	ConnectionRateLimit RateLimit
+	SenderRateLimit     RateLimit
+	RecipientRateLimit  RateLimit
+
+	// EnableFaults turns on fault injection: rules managed through Faults
+	// or the /api/v1/faults endpoints make matching commands fail on
+	// purpose. The API is unauthenticated, so only enable it where every
+	// client of the HTTP port is trusted.
+	EnableFaults bool
+
+	// ShutdownTimeout bounds how long in-flight sessions are drained when the
+	// context passed to ListenAndServe is cancelled. Defaults to 30s.
+	ShutdownTimeout time.Duration
+}
+
+// DefaultShutdownTimeout is used when Options.ShutdownTimeout is zero
+const DefaultShutdownTimeout = 30 * time.Second
+
+// Server is a single nullmail instance
+type Server struct {
+	opts   Options
+	smtp   *smtp.SMTPServer
+	api    *api.Server
+	http   *http.Server
+	faults *faults.Set
+	events events.Broker
+
+	// set before ready is closed
+	listener     net.Listener
+	tlsListener  net.Listener
+	httpListener net.Listener
+	ready        chan struct{}
+	once         sync.Once
+
+	closeStore sync.Once
+}
+
+// New creates a server. Nothing is bound until ListenAndServe is called.
+func New(opts Options) *Server {
+	if opts.Addr == "" {
+		opts.Addr = smtp.DefaultPort
+	}
+	if opts.Store == nil {
+		opts.Store = storage.NewMemoryStore(storage.DefaultMaxMessages)
+	}
+	if opts.ShutdownTimeout <= 0 {
+		opts.ShutdownTimeout = DefaultShutdownTimeout
+	}
+
+	var faultSet *faults.Set
+	if opts.EnableFaults {
+		faultSet = faults.NewSet()
+	}
+	broker := eventBroker(opts.Store)
+	apiServer := api.NewServer(opts.Store, faultSet, broker)
+
+	return &Server{
+		opts:   opts,
+		smtp:   smtp.NewSMTPServer(opts.Store, smtpConfig(opts, faultSet, broker)),
+		api:    apiServer,
+		faults: faultSet,
+		events: broker,
+		http: &http.Server{
+			Handler:      apiServer,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		},
+		ready: make(chan struct{}),
+	}
+}
+
+func smtpConfig(opts Options, faultSet *faults.Set, broker events.Broker) smtp.Config {
+	return smtp.Config{
+		Auth: smtp.AuthConfig{
+			Users:     opts.AuthUsers,
+			AcceptAny: opts.AuthAcceptAny,
+		},
+		TLS: smtp.TLSConfig{
+			CertFile: opts.TLSCertFile,
+			KeyFile:  opts.TLSKeyFile,
+			DevCADir: opts.TLSDevCADir,
+			Require:  opts.RequireTLS,
+		},
+		Limits: smtp.LimitsConfig{
+			CommandTimeout:   opts.CommandTimeout,
+			DataTimeout:      opts.DataTimeout,
+			MaxSessions:      opts.MaxSessions,
+			MaxSessionsPerIP: opts.MaxSessionsPerIP,
+		},
+		Domains: smtp.DomainConfig{
+			Local:    opts.LocalDomains,
+			Hostname: opts.Hostname,
+		},
+		RateLimit: smtp.RateLimitConfig{
+			ConnectionsPerIP:     opts.ConnectionRateLimit,
+			MessagesPerSender:    opts.SenderRateLimit,
+			MessagesPerRecipient: opts.RecipientRateLimit,
+			Limiter:              rateLimiter(opts.Store),
+		},
+		Faults: faultSet,
+		Events: broker,
+	}
+}
+
+// rateLimiter shares the Redis connection of a Redis store. Other stores
+// get the in-process default.
+func rateLimiter(store Store) ratelimit.Limiter {
+	if redisStore, ok := store.(*storage.RedisStore); ok {
+		return ratelimit.NewRedisLimiter(redisStore.Client())
+	}
+	return nil
+}
+
+// eventBroker publishes through Redis pub/sub when the store is the Redis
+// store, so event streams on every replica see all mail. Other stores get
+// an in-process broker.
+func eventBroker(store Store) events.Broker {
+	if redisStore, ok := store.(*storage.RedisStore); ok {
+		return events.NewRedisBroker(redisStore.Client())
+	}
+	return events.NewMemoryBroker()
+}
+
+// ListenAndServe binds the SMTP listener, and the SMTPS and HTTP listeners
+// if configured, and serves until ctx is cancelled or Shutdown is called. When
+// ctx is cancelled it drains sessions for up to Options.ShutdownTimeout
+// before returning.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	listeners, err := s.listen()
+	bound := false
+	s.once.Do(func() {
+		s.listener = listeners.smtp
+		s.tlsListener = listeners.smtps
+		s.httpListener = listeners.http
+		bound = err == nil
+		close(s.ready)
+	})
+	if err != nil {
+		return err
+	}
+	if !bound {
+		// Shutdown was called before the listeners were bound
+		listeners.close()
+		return nil
+	}
+	listener, tlsListener, httpListener := listeners.smtp, listeners.smtps, listeners.http
+
+	serveErr := make(chan error, 3)
+	go func() {
+		serveErr <- s.smtp.Serve(listener)
+	}()
+
+	if tlsListener != nil {
+		go func() {
+			if err := s.smtp.ServeTLS(tlsListener); err != nil {
+				serveErr <- fmt.Errorf("nullmail: smtps: %w", err)
+			}
+		}()
+	}
+
+	if httpListener != nil {
+		go func() {
+			slog.Info("HTTP API started", "addr", httpListener.Addr().String())
+			if err := s.http.Serve(httpListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				serveErr <- fmt.Errorf("nullmail: http: %w", err)
+			}
+		}()
+	}
+
+	select {
+	case err := <-serveErr:
+		if err == nil || errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		// One listener failed; stop the others instead of leaving them
+		// serving behind a returned error
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.opts.ShutdownTimeout)
+		defer cancel()
+
+		if shutdownErr := s.Shutdown(shutdownCtx); shutdownErr != nil {
+			slog.Error("Shutdown after serve error failed", "error", shutdownErr)
+		}
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.opts.ShutdownTimeout)
+		defer cancel()
+
+		err := s.Shutdown(shutdownCtx)
+		<-serveErr
+		return err
+	}
+}
+
+// boundListeners holds the listeners of one ListenAndServe call. Optional
+// listeners are nil when not configured.
+type boundListeners struct {
+	smtp  net.Listener
+	smtps net.Listener
+	http  net.Listener
+}
+
+func (l boundListeners) close() {
+	for _, listener := range []net.Listener{l.smtp, l.smtps, l.http} {
+		if listener != nil {
+			listener.Close()
+		}
+	}
+}
+
+func (s *Server) listen() (boundListeners, error) {
+	if err := s.smtp.Err(); err != nil {
+		return boundListeners{}, fmt.Errorf("nullmail: %w", err)
+	}
+
+	var listeners boundListeners
+
+	bind := func(addr string) (net.Listener, error) {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			listeners.close()
+			return nil, fmt.Errorf("nullmail: listen on %s: %w", addr, err)
+		}
+		return listener, nil
+	}
+
+	var err error
+	if listeners.smtp, err = bind(s.opts.Addr); err != nil {
+		return boundListeners{}, err
+	}
+	if s.opts.TLSAddr != "" {
+		if listeners.smtps, err = bind(s.opts.TLSAddr); err != nil {
+			return boundListeners{}, err
+		}
+	}
+	if s.opts.HTTPAddr != "" {
+		if listeners.http, err = bind(s.opts.HTTPAddr); err != nil {
+			return boundListeners{}, err
+		}
+	}
+	return listeners, nil
+}
+
+// Addr returns the bound SMTP address. It blocks until ListenAndServe has
+// bound its listener and returns nil if binding failed.
+func (s *Server) Addr() net.Addr {
+	<-s.ready
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// TLSAddr returns the bound implicit TLS address. Like Addr it blocks until
+// ListenAndServe has bound its listeners, and returns nil if SMTPS is
+// disabled or binding failed.
+func (s *Server) TLSAddr() net.Addr {
+	<-s.ready
+	if s.tlsListener == nil {
+		return nil
+	}
+	return s.tlsListener.Addr()
+}
+
+// HTTPAddr returns the bound HTTP API address. Like Addr it blocks until
+// ListenAndServe has bound its listeners, and returns nil if the API is
+// disabled or binding failed.
+func (s *Server) HTTPAddr() net.Addr {
+	<-s.ready
+	if s.httpListener == nil {
+		return nil
+	}
+	return s.httpListener.Addr()
+}
+
+// Handler returns the REST API handler, for mounting on another server or
+// using with net/http/httptest
+func (s *Server) Handler() http.Handler {
+	return s.api
+}
+
+// Faults returns the fault rules applied by the SMTP server. Rules can be
+// added and removed while the server runs, here or through the HTTP API.
+// It returns nil unless Options.EnableFaults is set.
+func (s *Server) Faults() *FaultSet {
+	return s.faults
+}
+
+// Store returns the store messages are persisted to
+func (s *Server) Store() Store {
+	return s.opts.Store
+}
+
+// Shutdown stops accepting connections, waits until in-flight sessions have
+// finished storing their messages or ctx expires, and then stops the HTTP API,
+// ending open event streams, and closes the store.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.once.Do(func() { close(s.ready) })
+
+	err := s.smtp.Shutdown(ctx)
+
+	s.api.Close()
+	if s.httpListener != nil {
+		if httpErr := s.http.Shutdown(ctx); httpErr != nil && err == nil {
+			err = httpErr
+		}
+	}
+
+	s.closeStore.Do(func() {
+		if closer, ok := s.events.(io.Closer); ok {
+			closer.Close()
+		}
+		if closeErr := s.opts.Store.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	})
+	return err
+}
@@ -0,0 +1,195 @@
+package nullmail
+
+import (
+	"context"
+	"net/smtp"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startServer runs a server on an ephemeral port and shuts it down when the
+// test ends
+func startServer(t *testing.T, opts Options) *Server {
+	t.Helper()
+
+	if opts.Addr == "" {
+		opts.Addr = "127.0.0.1:0"
+	}
+	srv := New(opts)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.ListenAndServe(context.Background())
+	}()
+	if srv.Addr() == nil {
+		t.Fatalf("ListenAndServe failed: %v", <-done)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := srv.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("ListenAndServe: %v", err)
+		}
+	})
+	return srv
+}
+
+// sendMail delivers a message in plain text. net/smtp.SendMail would use
+// the advertised STARTTLS and reject the development certificate.
+func sendMail(t *testing.T, addr, from string, to []string, msg string) {
+	t.Helper()
+
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.Hello("client.example.com"); err != nil {
+		t.Fatalf("EHLO: %v", err)
+	}
+	if err := client.Mail(from); err != nil {
+		t.Fatalf("MAIL: %v", err)
+	}
+	for _, recipient := range to {
+		if err := client.Rcpt(recipient); err != nil {
+			t.Fatalf("RCPT %s: %v", recipient, err)
+		}
+	}
+
+	data, err := client.Data()
+	if err != nil {
+		t.Fatalf("DATA: %v", err)
+	}
+	if _, err := data.Write([]byte(msg)); err != nil {
+		t.Fatalf("writing message: %v", err)
+	}
+	if err := data.Close(); err != nil {
+		t.Fatalf("end of DATA: %v", err)
+	}
+	if err := client.Quit(); err != nil {
+		t.Fatalf("QUIT: %v", err)
+	}
+}
+
+func TestSendAndList(t *testing.T) {
+	srv := startServer(t, Options{})
+
+	msg := "From: sender@example.com\r\n" +
+		"To: alice@example.com, bob@example.com\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n" +
+		".leading dot\r\n" +
+		"body\r\n"
+	sendMail(t, srv.Addr().String(), "sender@example.com", []string{"alice@example.com", "Bob@Example.com"}, msg)
+
+	for _, recipient := range []string{"alice@example.com", "bob@example.com"} {
+		ids, err := srv.Store().ListByRecipient(recipient)
+		if err != nil {
+			t.Fatalf("ListByRecipient(%s): %v", recipient, err)
+		}
+		if len(ids) != 1 {
+			t.Fatalf("ListByRecipient(%s) = %v, want one message", recipient, ids)
+		}
+
+		stored, err := srv.Store().Get(ids[0])
+		if err != nil {
+			t.Fatalf("Get(%s): %v", ids[0], err)
+		}
+		if stored.Subject != "Hello" {
+			t.Errorf("Subject = %q, want %q", stored.Subject, "Hello")
+		}
+		if stored.From != "sender@example.com" {
+			t.Errorf("From = %q, want %q", stored.From, "sender@example.com")
+		}
+		if stored.Envelope == nil || stored.Envelope.HeloName != "client.example.com" {
+			t.Errorf("Envelope = %+v, want HELO name client.example.com", stored.Envelope)
+		}
+
+		raw, err := srv.Store().GetRaw(ids[0])
+		if err != nil {
+			t.Fatalf("GetRaw(%s): %v", ids[0], err)
+		}
+		if string(raw) != msg {
+			t.Errorf("raw message = %q, want %q", raw, msg)
+		}
+	}
+}
+
+func TestLocalDomains(t *testing.T) {
+	srv := startServer(t, Options{LocalDomains: []string{"example.com"}})
+
+	client, err := smtp.Dial(srv.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.Mail("sender@example.com"); err != nil {
+		t.Fatalf("MAIL: %v", err)
+	}
+	if err := client.Rcpt("user@example.com"); err != nil {
+		t.Errorf("RCPT to a local domain: %v", err)
+	}
+	if err := client.Rcpt("user@elsewhere.example.org"); err == nil {
+		t.Error("RCPT to a foreign domain was accepted")
+	}
+}
+
+func TestListenAndServeContextCancel(t *testing.T) {
+	srv := New(Options{Addr: "127.0.0.1:0"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.ListenAndServe(ctx)
+	}()
+	if srv.Addr() == nil {
+		t.Fatalf("ListenAndServe failed: %v", <-done)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("ListenAndServe = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe did not return after the context was cancelled")
+	}
+}
+
+func TestShutdownBeforeListen(t *testing.T) {
+	srv := New(Options{Addr: "127.0.0.1:0"})
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if err := srv.ListenAndServe(context.Background()); err != nil {
+		t.Fatalf("ListenAndServe after Shutdown = %v, want nil", err)
+	}
+	if srv.Addr() != nil {
+		t.Errorf("Addr = %v, want nil", srv.Addr())
+	}
+}
+
+func TestListenAndServeCertificateError(t *testing.T) {
+	dir := t.TempDir()
+	srv := New(Options{
+		Addr:        "127.0.0.1:0",
+		TLSCertFile: filepath.Join(dir, "missing.crt"),
+		TLSKeyFile:  filepath.Join(dir, "missing.key"),
+	})
+
+	if err := srv.ListenAndServe(context.Background()); err == nil {
+		t.Fatal("ListenAndServe = nil for a certificate that does not exist")
+	}
+	if srv.Addr() != nil {
+		t.Errorf("Addr = %v, want nil", srv.Addr())
+	}
+}